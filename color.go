@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var (
+	ErrorNoICCProfile      = errors.New("no iCCP chunk")
+	ErrorInvalidICCProfile = errors.New("invalid iCCP chunk")
+)
+
+//ICCProfile extracts the embedded colour profile from the iCCP chunk, returning the profile name
+//and the inflated ICC data. ErrorNoICCProfile is returned when the image doesn't carry one.
+func (p *PNG) ICCProfile() (name string, data []byte, err error) {
+	if len(p.Chunks["iCCP"]) == 0 {
+		return "", nil, ErrorNoICCProfile
+	}
+
+	// name\0 method compressed-profile
+	keyword, rest, ok := cutNull(p.Chunks["iCCP"][0].Data)
+	if !ok || len(keyword) == 0 || len(rest) == 0 {
+		return "", nil, ErrorInvalidICCProfile
+	}
+
+	if method := rest[0]; method != 0 {
+		return "", nil, fmt.Errorf("%w: unknown compression method %d", ErrorInvalidICCProfile, method)
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(rest[1:]))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrorInvalidICCProfile, err)
+	}
+	defer r.Close()
+
+	if data, err = ioutil.ReadAll(r); err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrorInvalidICCProfile, err)
+	}
+	return latin1(keyword), data, nil
+}
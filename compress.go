@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compressor is an external tool that re-encodes the stripped PNG into another format
+type compressor struct {
+	// binary is the executable to run, looked up on PATH unless it's a path
+	binary string
+	// extension is given to the files it produces
+	extension string
+	// args builds the command line turning input into output
+	args func(c compressor, input, output string) []string
+
+	// quality goes from 0 to 100, in lossless mode it trades speed for size
+	quality  int
+	lossless bool
+	// retries is how many times a failed run is tried again, the first after backoff
+	// and each one after that waiting twice as long
+	retries int
+	backoff time.Duration
+}
+
+// compressors maps the -compressor names to their tools
+var compressors = map[string]compressor{
+	"webp": {binary: "cwebp", extension: ".webp", args: webpArgs},
+	"avif": {binary: "avifenc", extension: ".avif", args: avifArgs},
+}
+
+// webpArgs builds the cwebp arguments
+func webpArgs(c compressor, input, output string) []string {
+	args := []string{"-q", strconv.Itoa(c.quality)}
+	if c.lossless {
+		args = append(args, "-lossless")
+	}
+	return append(args, input, "-o", output)
+}
+
+// avifArgs builds the avifenc arguments
+func avifArgs(c compressor, input, output string) []string {
+	args := []string{"-q", strconv.Itoa(c.quality)}
+	if c.lossless {
+		args = append(args, "--lossless")
+	}
+	return append(args, input, output)
+}
+
+// compress runs the compressor over the PNG bytes, writing the result to output
+func (c compressor) compress(png []byte, output string) error {
+	temp, err := ioutil.TempFile("", "strip-*.png")
+
+	if err != nil {
+		return err
+	}
+
+	// gone whichever way this returns
+	defer os.Remove(temp.Name())
+
+	// a short write would hand the compressor a truncated image
+	if _, err = temp.Write(png); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err = temp.Close(); err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.binary, c.args(c, temp.Name(), output)...)
+	cmd.Stderr = &stderr
+
+	// wait for the compressor to finish, otherwise we can exit before the output is written
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed on %s: %v: %s", c.binary, output, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// compressRetrying runs compress, trying again after a growing pause when it fails. A loaded machine
+// can fail to spawn the compressor at all, which usually works a moment later.
+func (c compressor) compressRetrying(ctx context.Context, png []byte, output string) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := c.compress(png, output)
+		if err == nil || attempt >= c.retries {
+			return err
+		}
+
+		logf("retrying %s in %v: %v", output, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
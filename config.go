@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// loadConfig reads a JSON object of flag names to values from path, e.g. {"keep": ["PLTE", "tRNS"],
+// "routines": 8}, and applies every value whose flag wasn't given so the command line always wins
+func loadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// keep numbers as written, a float64 would turn large sizes into exponents
+	decoder.UseNumber()
+
+	var values map[string]interface{}
+	if err = decoder.Decode(&values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	// visit in a fixed order so the same bad file always reports the same error
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown flag %q", path, name)
+		}
+
+		if isFlagSet(name) {
+			continue
+		}
+
+		value, err := configValue(values[name])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+
+		if err = flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// configValue turns a JSON value into the string the flag would be given on the command line,
+// arrays becoming comma separated lists
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case json.Number:
+		return v.String(), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("list items must be strings, got %v", item)
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
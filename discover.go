@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//DiscoverOptions controls which files Discover finds under its root
+type DiscoverOptions struct {
+	// Pattern, when set, picks files by matching their slash separated path relative to the root
+	// with matchGlob instead of by their .png extension
+	Pattern string
+	// ByContent picks files starting with the PNG signature whatever they're called, on top of
+	// matching Pattern when that's set
+	ByContent bool
+	// Recursive walks the subdirectories of the root too
+	Recursive bool
+	// FollowSymlinks descends into symlinked directories as well, each directory is only walked
+	// once however many links lead to it so link cycles end
+	FollowSymlinks bool
+	// OnError is called for every entry that can't be read, which is skipped rather than ending
+	// the walk. It's also called with a bad Pattern before the walk stops.
+	OnError func(path string, err error)
+}
+
+//Discover walks root in the background, sending the path of every file opts picks on the
+//returned channel and closing it once the walk is over or ctx is cancelled. Only a root that
+//can't be read at all is returned as an error.
+func Discover(ctx context.Context, root string, opts DiscoverOptions) (<-chan string, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+
+	walk := filepath.Walk
+	if opts.FollowSymlinks {
+		walk = walkFollowingLinks
+	}
+
+	paths := make(chan string)
+	go func() {
+		defer close(paths)
+
+		walk(root, func(path string, info os.FileInfo, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if err != nil {
+				if opts.OnError != nil {
+					opts.OnError(path, err)
+				}
+				return nil
+			}
+
+			if info.IsDir() {
+				if !opts.Recursive && path != root {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			matched, err := discovers(root, path, info, opts)
+			if err != nil {
+				if opts.OnError != nil {
+					opts.OnError(path, err)
+				}
+				// a bad pattern fails every file the same way, anything else only concerns this one
+				if isBadPattern(err) {
+					return err
+				}
+				return nil
+			}
+
+			if !matched {
+				return nil
+			}
+
+			select {
+			case paths <- path:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return paths, nil
+}
+
+// discovers reports whether the file at path under root is one Discover should send
+func discovers(root, path string, info os.FileInfo, opts DiscoverOptions) (bool, error) {
+	if opts.Pattern != "" {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return false, err
+		}
+
+		if matched, err := matchGlob(opts.Pattern, filepath.ToSlash(rel)); !matched || err != nil {
+			return false, err
+		}
+	} else if !opts.ByContent {
+		return strings.HasSuffix(info.Name(), ".png") || strings.HasSuffix(info.Name(), ".png.gz"), nil
+	}
+
+	if opts.ByContent {
+		return sniffPNG(path)
+	}
+	return true, nil
+}
+
+// sniffPNG reports whether the file at path starts with the PNG signature, looking inside it when
+// it's gzipped. Only the first four bytes have to match, they survive the line ending conversions
+// that damage the rest.
+func sniffPNG(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	input, _, err := decompress(f)
+	if err != nil {
+		return false, err
+	}
+
+	magic := make([]byte, 4)
+	if _, err = io.ReadFull(input, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(magic, PNGHeader[:4]), nil
+}
+
+// decompress returns a reader giving the PNG in f, unpacking it on the way when f is gzipped
+func decompress(f *os.File) (io.Reader, bool, error) {
+	magic := make([]byte, 2)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+
+	if n < len(magic) || magic[0] != 0x1f || magic[1] != 0x8b {
+		return f, false, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, false, err
+	}
+	return gz, true, nil
+}
+
+// walkFollowingLinks walks root like filepath.Walk, but with symlinks resolved so linked directories
+// are walked too. Directories already walked are skipped, which is what stops link cycles.
+func walkFollowingLinks(root string, walkFn filepath.WalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+
+	// keyed by the real path of each directory, whatever links led to it
+	seen := map[string]bool{}
+	var walk func(path string, info os.FileInfo) error
+	walk = func(path string, info os.FileInfo) error {
+		if !info.IsDir() {
+			return walkFn(path, info, nil)
+		}
+
+		real, err := realPath(path)
+		if err != nil {
+			if err = walkFn(path, info, err); err != filepath.SkipDir {
+				return err
+			}
+			return nil
+		}
+		if seen[real] {
+			return nil
+		}
+		seen[real] = true
+
+		if err := walkFn(path, info, nil); err != nil {
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
+		}
+
+		names, err := readDirNames(path)
+		if err != nil {
+			if err = walkFn(path, info, err); err != filepath.SkipDir {
+				return err
+			}
+			return nil
+		}
+
+		for _, name := range names {
+			name = filepath.Join(path, name)
+			info, err := os.Stat(name)
+			if err != nil {
+				// a dangling link
+				if err = walkFn(name, nil, err); err != nil && err != filepath.SkipDir {
+					return err
+				}
+				continue
+			}
+
+			if err = walk(name, info); err != nil {
+				// skipping from a file skips the rest of its directory
+				if err == filepath.SkipDir {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root, info)
+}
+
+// realPath resolves every link on the way to path, making it absolute first so the same
+// directory gets the same path however it was reached
+func realPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// readDirNames lists the entries of a directory sorted by name, the order filepath.Walk uses
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
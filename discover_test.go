@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// discover collects what Discover sends for root along with the paths it reported errors for
+func discover(t *testing.T, root string, opts DiscoverOptions) (found, failed []string) {
+	t.Helper()
+
+	opts.OnError = func(path string, err error) {
+		failed = append(failed, path)
+	}
+
+	paths, err := Discover(context.Background(), root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path := range paths {
+		found = append(found, path)
+	}
+	sort.Strings(found)
+	return found, failed
+}
+
+func TestDiscoverCarriesOnPastUnsniffableFiles(t *testing.T) {
+	root := t.TempDir()
+	png := encode(t, palettePNG(t)...)
+	writeFile(t, filepath.Join(root, "a.png"), png)
+	// gzip magic followed by something that isn't gzip
+	broken := filepath.Join(root, "b.png")
+	writeFile(t, broken, []byte{0x1f, 0x8b, 'n', 'o', 't', ' ', 'g', 'z', 'i', 'p'})
+	writeFile(t, filepath.Join(root, "sub", "c.bin"), png)
+
+	found, failed := discover(t, root, DiscoverOptions{ByContent: true, Recursive: true})
+
+	want := []string{filepath.Join(root, "a.png"), filepath.Join(root, "sub", "c.bin")}
+	if len(found) != len(want) || found[0] != want[0] || found[1] != want[1] {
+		t.Errorf("found %v, want %v", found, want)
+	}
+	if len(failed) != 1 || failed[0] != broken {
+		t.Errorf("errors reported for %v, want %s", failed, broken)
+	}
+}
+
+func TestDiscoverStopsOnBadPattern(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a.png"), encode(t, palettePNG(t)...))
+	writeFile(t, filepath.Join(root, "b.png"), encode(t, palettePNG(t)...))
+
+	found, failed := discover(t, root, DiscoverOptions{Pattern: "[", Recursive: true})
+	if len(found) != 0 || len(failed) != 1 {
+		t.Errorf("found %v with errors for %v, want nothing found and one error", found, failed)
+	}
+}
+
+func TestDiscoverFollowsLinksOnce(t *testing.T) {
+	root, shared := t.TempDir(), t.TempDir()
+	png := encode(t, palettePNG(t)...)
+	writeFile(t, filepath.Join(root, "a.png"), png)
+	writeFile(t, filepath.Join(shared, "x.png"), png)
+
+	// a cycle back to the root and two links to the same directory
+	for name, target := range map[string]string{"loop": root, "again": shared, "shared": shared} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, failed := discover(t, root, DiscoverOptions{Recursive: true, FollowSymlinks: true})
+	want := []string{filepath.Join(root, "a.png"), filepath.Join(root, "again", "x.png")}
+	if len(found) != len(want) || found[0] != want[0] || found[1] != want[1] || len(failed) > 0 {
+		t.Errorf("found %v with errors for %v, want %v", found, failed, want)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// matchGlob reports whether the slash separated name matches pattern. Segments are matched
+// with path.Match, and a "**" segment matches any number of directories, including none.
+func matchGlob(pattern, name string) (bool, error) {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// try swallowing zero, one, two... of the remaining segments
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchSegments(pattern[1:], name[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(name) == 0 {
+			return false, nil
+		}
+
+		ok, err := path.Match(pattern[0], name[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
+
+// isBadPattern reports whether err is matchGlob rejecting its pattern
+func isBadPattern(err error) bool {
+	return errors.Is(err, path.ErrBadPattern)
+}
+
+// globBase splits the leading segments of pattern that contain no wildcards from the rest,
+// so only the directory that can match has to be walked
+func globBase(pattern string) (base, rest string) {
+	segments := strings.Split(pattern, "/")
+	i := 0
+	for ; i < len(segments)-1; i++ {
+		if strings.ContainsAny(segments[i], "*?[\\") {
+			break
+		}
+	}
+	return strings.Join(segments[:i], "/"), strings.Join(segments[i:], "/")
+}
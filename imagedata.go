@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+var (
+	ErrorBadFilter     = errors.New("unknown scanline filter")
+	ErrorImageDataSize = errors.New("image data doesn't match the IHDR dimensions")
+	ErrorBitDepth      = errors.New("invalid bit depth for the colour type")
+	ErrorAnimated      = errors.New("can't rewrite the image data of an animated PNG")
+)
+
+// channels is the number of samples per pixel for each colour type
+var channels = map[uint8]int{
+	0: 1, // grayscale
+	2: 3, // truecolour
+	3: 1, // indexed
+	4: 2, // grayscale with alpha
+	6: 4, // truecolour with alpha
+}
+
+// bitDepths lists the bit depths the spec allows for each colour type
+var bitDepths = map[uint8][]uint8{
+	0: {1, 2, 4, 8, 16},
+	2: {8, 16},
+	3: {1, 2, 4, 8},
+	4: {8, 16},
+	6: {8, 16},
+}
+
+// adam7 holds the x and y offset and step of each of the seven interlacing passes
+var adam7 = [7][4]int{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+// imageData holds the unfiltered scanlines of an image
+type imageData struct {
+	width, height uint32
+	bitDepth      uint8
+	colorType     uint8
+	// bitsPerPixel is the size of one pixel, pixels smaller than a byte are packed
+	bitsPerPixel int
+	// passes holds the seven Adam7 passes of an interlaced image, or the whole image as one pass
+	passes []*pass
+}
+
+// pass is a reduced image of its own, each scanline filtered independently of the other passes
+type pass struct {
+	width, height uint32
+	rows          [][]byte
+}
+
+// decodeImageData inflates the IDAT stream and undoes the scanline filters
+func (p *PNG) decodeImageData() (*imageData, error) {
+	width, height, bitDepth, colorType, _, _, interlace, err := p.IHDR()
+	if err != nil {
+		return nil, err
+	}
+
+	samples, ok := channels[colorType]
+	if !ok {
+		return nil, fmt.Errorf("unknown colour type %d", colorType)
+	}
+
+	if !validBitDepth(colorType, bitDepth) {
+		return nil, fmt.Errorf("%w: %d bits with colour type %d", ErrorBitDepth, bitDepth, colorType)
+	}
+
+	if interlace > 1 {
+		return nil, fmt.Errorf("unknown interlace method %d", interlace)
+	}
+
+	img := &imageData{
+		width:        width,
+		height:       height,
+		bitDepth:     bitDepth,
+		colorType:    colorType,
+		bitsPerPixel: samples * int(bitDepth),
+	}
+
+	if interlace == 0 {
+		img.passes = []*pass{{width: width, height: height}}
+	} else {
+		for _, a := range adam7 {
+			img.passes = append(img.passes, &pass{
+				width:  passSize(width, a[0], a[2]),
+				height: passSize(height, a[1], a[3]),
+			})
+		}
+	}
+
+	// the IHDR says what the stream inflates to, reading no further stops a few bytes of IDAT
+	// inflating to gigabytes
+	size, ok := img.size()
+	if !ok {
+		return nil, ErrorImageDataSize
+	}
+
+	var compressed bytes.Buffer
+	for _, chunk := range p.Chunks["IDAT"] {
+		compressed.Write(chunk.Data)
+	}
+
+	r, err := zlib.NewReader(&compressed)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(r, size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) > size {
+		return nil, fmt.Errorf("%w: inflates to more than %d bytes", ErrorImageDataSize, size)
+	}
+
+	for _, pass := range img.passes {
+		// empty passes of small images take up no bytes at all
+		if pass.width == 0 || pass.height == 0 {
+			continue
+		}
+
+		// checked before anything is allocated, the IHDR can claim images far bigger than memory
+		if !filteredFits(len(raw), pass.width, pass.height, img.bitsPerPixel) {
+			return nil, ErrorImageDataSize
+		}
+		size := (rowBytes(pass.width, img.bitsPerPixel) + 1) * int(pass.height)
+
+		if pass.rows, err = unfilter(raw[:size], pass.width, pass.height, img.bitsPerPixel); err != nil {
+			return nil, err
+		}
+		raw = raw[size:]
+	}
+	return img, nil
+}
+
+// completeImageData checks the IDAT chunks hold the whole image the IHDR describes, a file cut
+// short in the middle of them decodes to less
+func (p *PNG) completeImageData() error {
+	if len(p.Chunks["IDAT"]) == 0 {
+		return fmt.Errorf("%w: no IDAT chunks", ErrorMissingChunk)
+	}
+	_, err := p.decodeImageData()
+	return err
+}
+
+// size is how many bytes the filtered scanlines of every pass take up, ok is false when that
+// doesn't even fit in an int64
+func (img *imageData) size() (size int64, ok bool) {
+	for _, pass := range img.passes {
+		if pass.width == 0 || pass.height == 0 {
+			continue
+		}
+
+		stride := (uint64(pass.width)*uint64(img.bitsPerPixel)+7)/8 + 1
+		if stride > uint64(math.MaxInt64-size)/uint64(pass.height) {
+			return 0, false
+		}
+		size += int64(stride * uint64(pass.height))
+	}
+	return size, true
+}
+
+// validBitDepth reports whether the spec allows bitDepth for colorType
+func validBitDepth(colorType, bitDepth uint8) bool {
+	for _, depth := range bitDepths[colorType] {
+		if depth == bitDepth {
+			return true
+		}
+	}
+	return false
+}
+
+// passSize is how many pixels of a dimension an interlacing pass starting at offset covers
+func passSize(size uint32, offset, step int) uint32 {
+	if int(size) <= offset {
+		return 0
+	}
+	return uint32((int(size) - offset + step - 1) / step)
+}
+
+// rowBytes is the size of one scanline without its filter byte
+func rowBytes(width uint32, bitsPerPixel int) int {
+	return (int(width)*bitsPerPixel + 7) / 8
+}
+
+// filteredFits reports whether n bytes hold height scanlines of width pixels along with their filter
+// bytes. It divides rather than multiplying the sizes out, the largest images an IHDR can describe
+// overflow even 64 bits.
+func filteredFits(n int, width, height uint32, bitsPerPixel int) bool {
+	stride := (uint64(width)*uint64(bitsPerPixel)+7)/8 + 1
+	return height == 0 || stride <= uint64(n)/uint64(height)
+}
+
+// unfilter splits the raw inflated data into scanlines and reverses the filter on each
+func unfilter(raw []byte, width, height uint32, bitsPerPixel int) ([][]byte, error) {
+	if !filteredFits(len(raw), width, height, bitsPerPixel) {
+		return nil, ErrorImageDataSize
+	}
+	stride := rowBytes(width, bitsPerPixel)
+
+	// filters work on whole bytes, so packed pixels count as one byte
+	bpp := (bitsPerPixel + 7) / 8
+	rows := make([][]byte, height)
+	previous := make([]byte, stride)
+
+	for y := range rows {
+		line := raw[y*(stride+1) : (y+1)*(stride+1)]
+		filter, row := line[0], make([]byte, stride)
+		copy(row, line[1:])
+
+		for i := range row {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = row[i-bpp], previous[i-bpp]
+			}
+			up := previous[i]
+
+			switch filter {
+			case 0:
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			default:
+				return nil, fmt.Errorf("%w %d on row %d", ErrorBadFilter, filter, y)
+			}
+		}
+
+		rows[y] = row
+		previous = row
+	}
+	return rows, nil
+}
+
+// paeth predicts a byte from its left, upper and upper left neighbours
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// encode deflates the scanlines back into an IDAT stream, pass by pass for interlaced images.
+// Every row uses filter 0 which the spec recommends for indexed images.
+func (img *imageData) encode() ([]byte, error) {
+	var compressed bytes.Buffer
+	w, err := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pass := range img.passes {
+		for _, row := range pass.rows {
+			if _, err = w.Write([]byte{0}); err != nil {
+				return nil, err
+			}
+			if _, err = w.Write(row); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// sample reads the value of pixel x from a row of single sample pixels packed at bitDepth
+func sample(row []byte, x int, bitDepth uint8) byte {
+	if bitDepth == 8 {
+		return row[x]
+	}
+
+	perByte := 8 / int(bitDepth)
+	shift := uint(8 - int(bitDepth)*(x%perByte+1))
+	return row[x/perByte] >> shift & (1<<bitDepth - 1)
+}
+
+// setSample writes the value of pixel x into a row of single sample pixels packed at bitDepth
+func setSample(row []byte, x int, bitDepth uint8, value byte) {
+	if bitDepth == 8 {
+		row[x] = value
+		return
+	}
+
+	perByte := 8 / int(bitDepth)
+	shift := uint(8 - int(bitDepth)*(x%perByte+1))
+	mask := byte(1<<bitDepth-1) << shift
+	row[x/perByte] = row[x/perByte]&^mask | value<<shift&mask
+}
+
+// replaceImageData swaps every IDAT chunk for a single one holding data
+func (p *PNG) replaceImageData(data []byte) {
+	idat := &Chunk{Type: "IDAT", Data: data}
+	idat.UpdateCRC()
+
+	order := make([]*Chunk, 0, len(p.Order))
+	written := false
+	for _, chunk := range p.Order {
+		if chunk.Type != "IDAT" {
+			order = append(order, chunk)
+		} else if !written {
+			order = append(order, idat)
+			written = true
+		}
+	}
+
+	p.Order = order
+	p.Chunks["IDAT"] = []*Chunk{idat}
+}
+
+// animated reports whether p is an APNG. Its fdAT frames are encoded like the IDAT, so
+// rewriting only the IDAT would leave them out of step with the IHDR and palette.
+func (p *PNG) animated() bool {
+	return len(p.Chunks["acTL"]) > 0 || len(p.Chunks["fdAT"]) > 0
+}
+
+// removeChunks drops every chunk of the given type
+func (p *PNG) removeChunks(chunkType string) {
+	order := p.Order[:0]
+	for _, chunk := range p.Order {
+		if chunk.Type != chunkType {
+			order = append(order, chunk)
+		}
+	}
+	p.Order = order
+	delete(p.Chunks, chunkType)
+}
+
+// insertBefore adds chunks just ahead of the first chunk of the given type, or at the end when
+// there's none
+func (p *PNG) insertBefore(chunkType string, chunks ...*Chunk) {
+	for _, chunk := range chunks {
+		p.Chunks[chunk.Type] = append(p.Chunks[chunk.Type], chunk)
+	}
+
+	// without Order the canonical order puts them in place already
+	if len(p.Order) == 0 {
+		return
+	}
+
+	for i, chunk := range p.Order {
+		if chunk.Type == chunkType {
+			order := append([]*Chunk{}, p.Order[:i]...)
+			order = append(order, chunks...)
+			p.Order = append(order, p.Order[i:]...)
+			return
+		}
+	}
+	p.Order = append(p.Order, chunks...)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeImageDataHugeIHDR(t *testing.T) {
+	// the largest image the IHDR allows, 2^31-1 pixels square at 64 bits each, with next to no data
+	for _, interlace := range []uint8{0, 1} {
+		header := ihdr(1<<31-1, 1<<31-1, 16, 6)
+		header.Data[12] = interlace
+		header.UpdateCRC()
+
+		chunks := append([]*Chunk{header}, idats(t, [][]byte{{}}, 1)...)
+		png := mustRead(t, encode(t, append(chunks, newChunk("IEND", nil))...))
+
+		if _, err := png.decodeImageData(); !errors.Is(err, ErrorImageDataSize) {
+			t.Errorf("interlace %d: got %v, want %v", interlace, err, ErrorImageDataSize)
+		}
+		if err := png.Quantize(16); err == nil {
+			t.Errorf("interlace %d: quantized an image with no data", interlace)
+		}
+	}
+}
+
+func TestDecodeImageDataBomb(t *testing.T) {
+	// two bytes of image data, the filter byte and one pixel, followed by megabytes of zeros
+	rows := [][]byte{make([]byte, 16<<20)}
+	chunks := append([]*Chunk{ihdr(1, 1, 8, 0)}, idats(t, rows, 1)...)
+	png := mustRead(t, encode(t, append(chunks, newChunk("IEND", nil))...))
+
+	if _, err := png.decodeImageData(); !errors.Is(err, ErrorImageDataSize) {
+		t.Errorf("got %v, want %v", err, ErrorImageDataSize)
+	}
+}
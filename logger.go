@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// verbosity is how much the run prints, picked with -quiet and -verbose
+type verbosity int
+
+const (
+	// quiet prints failures only
+	quiet verbosity = iota
+	// normal adds per file results, progress and run summaries
+	normal
+	// verbose adds every chunk kept or dropped and the workers starting and stopping
+	verbose
+)
+
+var level = normal
+
+// printf writes results to messages, silenced by -quiet
+func printf(format string, args ...interface{}) {
+	if level >= normal {
+		fmt.Fprintf(messages, format, args...)
+	}
+}
+
+// logf logs progress and problems that were recovered from, silenced by -quiet
+func logf(format string, args ...interface{}) {
+	if level >= normal {
+		log.Printf(format, args...)
+	}
+}
+
+// debugf logs the details only -verbose asks for
+func debugf(format string, args ...interface{}) {
+	if level >= verbose {
+		log.Printf(format, args...)
+	}
+}
+
+// errorf logs failures, always shown
+func errorf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
@@ -2,162 +2,1886 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	imagepng "image/png"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
 var (
+	// defaults for everything below, checked into the repo next to the assets
+	configFlag = flag.String("config", "", "read flag values from this JSON file, flags given on the command line win")
+
 	inputDirectory  = flag.String("input", "images", "The path to the PNGs that need to be fixed")
 	outputDirectory = flag.String("output", "processed", "The path to the output directory")
+	// tidy the output tree for packaging
+	pruneEmptyOutputDirsFlag = flag.Bool("prune-empty-output-dirs", false, "remove the directories this run created under -output that ended up empty")
+	// where in the output directory each file goes
+	outTemplateFlag = flag.String("out-template", "{dir}/{name}{ext}", "the output path below -output, mirroring the input tree by default. {dir} is the input's directory below -input, {name} its name without the extension and {ext} the extension")
 	// Used for checking passed in images
 	checkFlag = flag.Bool("check", false, "run with this flag if you just want to check for broken PNGs")
+	// set the damaged part of an archive aside
+	onlyBrokenFlag = flag.Bool("only-broken", false, "with -check, copy the files failing verification to the output directory unchanged and skip the intact ones")
 	// compress w/ webp
-	webpFlag = flag.Bool("compress", false, "compress the stripped down image with webp")
+	webpFlag            = flag.Bool("compress", false, "compress the stripped down image with webp, or the format picked by -compressor")
+	compressorFlag      = flag.String("compressor", "webp", "the format to compress to, webp (cwebp) or avif (avifenc)")
+	compressorPathFlag  = flag.String("compressor-path", "", "path to the compressor binary, looked up on PATH by default")
+	webpLosslessFlag    = flag.Bool("webp-lossless", true, "compress losslessly, set to false for lossy")
+	webpQualityFlag     = flag.Int("webp-quality", 75, "compression quality from 0 to 100, in lossless mode this trades speed for size")
+	compressRetriesFlag = flag.Int("compress-retries", 2, "how many times to retry a failed compressor run before giving up on the file")
+	compressBackoffFlag = flag.Duration("compress-backoff", 500*time.Millisecond, "the pause before the first compressor retry, doubling for each one after")
+	routeFlag           = flag.String("route", "", "pick the output format by colour type, e.g. gray=png,rgb=compress,rgba:16=png, the first match wins and -compress decides the rest")
+	smallestFlag        = flag.Bool("smallest", false, "with -compress, keep the stripped PNG instead of the compressed file whenever it's smaller")
+
+	// pick files by pattern rather than by the .png extension
+	globFlag = flag.String("glob", "", "only process files matching this pattern, relative to -input when given, ** matches any number of directories")
+	// only the top level of -input is processed when false
+	recursiveFlag = flag.Bool("recursive", true, "walk subdirectories of the input directory, set to false to skip them")
+	// estimate the savings of a huge tree from part of it
+	sampleFlag     = flag.Float64("sample", 1, "process each file the walk finds with this probability, e.g. 0.01 for a 1% sample")
+	sampleSeedFlag = flag.Int64("sample-seed", 1, "seed for -sample, the same seed picks the same files from the same tree")
+	// mislabelled files in messy archives
+	byContentFlag = flag.Bool("by-content", false, "pick files by the PNG signature at their start instead of the .png extension")
+	// shared asset folders linked into the tree
+	followSymlinksFlag = flag.Bool("follow-symlinks", false, "walk into symlinked directories too, each directory is walked once so link cycles end")
+
+	// try the options out on a sample first
+	maxFilesFlag = flag.Int64("max-files", 0, "stop after queueing this many files, 0 for no limit")
+	// stop at the first broken file
+	failFastFlag = flag.Bool("fail-fast", false, "stop processing new files after the first failure")
+
+	// look inside instead of stripping
+	listChunksFlag = flag.Bool("list-chunks", false, "print the type, length, offset and CRC status of every chunk instead of stripping")
+	listFormatFlag = flag.String("list-format", "table", "the -list-chunks output format, table or json")
+
+	// how chatty the run is
+	quietFlag   = flag.Bool("quiet", false, "only print errors")
+	verboseFlag = flag.Bool("verbose", false, "also log every chunk kept or dropped and the workers starting and stopping")
+
+	// log how far along the run is
+	progressFlag = flag.Duration("progress", 0, "log progress at this interval, e.g. 5s (0 disables)")
+
+	routinesFlag = routinesVar("routines", 16, "the amount of go routines to spawn, auto or 0 for one per CPU, never more than there are files")
+	// keep build caches keyed on mtime happy
+	preserveMtimeFlag = flag.Bool("preserve-mtime", false, "copy the modification time of each input onto its output")
+	// report what would be stripped without writing anything
+	dryRunFlag = flag.Bool("dry-run", false, "report which chunks would be stripped and the projected output size without writing any files")
+	// keep going past corrupt chunks
+	lenientFlag = flag.Bool("lenient", false, "recover what can be read from damaged files, dropping ancillary chunks with bad CRCs and failing files whose critical chunks are damaged")
+	// rewrite bad CRCs of otherwise intact chunks
+	fixCRCFlag = flag.Bool("fix-crc", false, "repair chunks whose CRC is wrong but whose data is intact instead of rejecting the file")
+	// machine readable results for CI
+	reportFlag = flag.String("report", "", "write a JSON report of every file's result to this path")
+	// which chunk types the wasted bytes are in
+	statsPerChunkTypeFlag = flag.Bool("stats-per-chunk-type", false, "print the chunks and bytes removed from all files by chunk type, largest first")
+	// throughput numbers for sizing batch jobs
+	metricsFlag = flag.String("metrics", "", "write the run's files and bytes per second as JSON to this path")
+	// where each input ended up, the extension changes when compressing
+	manifestFlag = flag.String("manifest", "", "write a JSON manifest mapping each input path to its output path and format")
+	// bigger reads for huge files on fast disks
+	readBufferFlag = flag.Int("read-buffer", 0, "size in bytes of the buffer used to read each input, 0 for the default of 4096")
+	// refuse chunks claiming to be bigger than this
+	maxChunkFlag = flag.Uint("max-chunk", uint(DefaultMaxChunkLength), "the largest chunk length in bytes accepted when reading, at most 4294967295")
+	// refuse compressed text inflating to more than this
+	maxTextFlag = flag.Int64("max-text", DefaultMaxTextLength, "the longest in bytes the text of a zTXt or iTXt chunk may inflate to when -check prints it")
+
+	// chunks to keep on top of the critical ones
+	keepFlag = flag.String("keep", "PLTE,tRNS", "comma separated list of chunk types to keep alongside the critical chunks, which are always kept, when not given every safe-to-copy chunk is kept too")
+	// keep animations working
+	keepAPNGFlag = flag.Bool("keep-apng", false, "keep the acTL, fcTL and fdAT chunks of animated PNGs")
+	// keep colour management
+	keepColorFlag = flag.Bool("keep-color", false, "keep the gAMA, cHRM, sRGB and iCCP chunks so colours render the same")
+	// keep the DPI of print assets
+	keepPhysFlag = flag.Bool("keep-phys", false, "keep the pHYs chunk holding the physical pixel size, even with -keep or -strip")
+	// chunks to remove, everything else is kept
+	stripFlag = flag.String("strip", "", "comma separated list of ancillary chunk types to remove, keeping all others (can't be used with -keep)")
+	// incremental runs
+	forceFlag = flag.Bool("force", false, "reprocess files even when their output already exists and is at least as new as the input")
+	// not worth the overhead on tiny icons
+	minSizeFlag = flag.Int64("min-size", 0, "copy files smaller than this many bytes to the output untouched instead of stripping them")
+	// safety net before overwriting originals
+	verifyOutputFlag = flag.Bool("verify-output", false, "decode every stripped image with image/png, deleting the output and failing the file if it doesn't decode")
+	// no separate output tree
+	inPlaceFlag = flag.Bool("in-place", false, "overwrite each input with its stripped version, replacing it atomically once written")
+	// identical icons copied all over the tree
+	dedupFlag = flag.Bool("dedup", false, "hard link outputs identical to one already written instead of writing another copy (can't be used with -in-place)")
+	// one IDAT instead of many small ones
+	mergeIDATFlag = flag.Bool("merge-idat", false, "join consecutive IDAT chunks into one, recomputing its length and CRC")
+	// lossy, trades colours for size
+	quantizeFlag = flag.Int("quantize", 0, "reduce truecolour images to an indexed palette of at most this many colours (2 to 256) with median cut, 0 disables")
+	// work as a filter in shell pipelines
+	stdinFlag  = flag.Bool("stdin", false, "strip a single PNG read from standard input instead of walking -input")
+	stdoutFlag = flag.Bool("stdout", false, "write the image read with -stdin to standard output instead of -output")
+	// drop unused palette entries of indexed images
+	trimPaletteFlag = flag.Bool("trim-palette", false, "shrink the palette of indexed PNGs to the colours actually used, rewriting the image data")
+	// provenance for everything we wrote
+	stampFlag = flag.String("stamp", "", "add a tEXt chunk holding key=value to every stripped image, kept whatever -keep and -strip say")
+)
+
+// options are the settings every file is processed with, setup builds them from the command line
+type options struct {
+	// output is the directory written to, each file going to the path template gives it below it
+	output, template string
+
+	// check verifies every chunk, onlyBroken copies the files failing that as they are
+	check, onlyBroken bool
+	// list prints the chunks of each file in listFormat instead of stripping it
+	list       bool
+	listFormat string
+
+	dryRun, inPlace, force, preserveMtime, verifyOutput, dedup, failFast bool
+	// minSize is the size below which files are copied untouched
+	minSize int64
+
+	// how the inputs are read
+	lenient, fixCRC bool
+	readBuffer      int
+	maxChunk        uint32
+	// maxText is the longest compressed text -check inflates
+	maxText int64
+
+	// quantize is the palette size to reduce truecolour images to, 0 to leave them alone
+	quantize    int
+	trimPalette bool
+	// stampKeyword is empty without -stamp
+	stampKeyword, stampText string
+
+	// compress sends every image to compressor unless one of routes says otherwise,
+	// routesCompress is set when any of them compresses
+	compress, smallest bool
+	routes             []route
+	routesCompress     bool
+	compressor         compressor
+
+	stripOptions StripOptions
+
+	// stdout writes the image read from stdin to stdout instead of the output directory
+	stdout bool
+
+	// claimed holds the outputs of the run so far, shared by every copy of the options
+	claimed *claimSet
+}
+
+// setup parses and checks the command line, exiting on anything it can't work with
+func setup() *options {
+	flag.Parse() // our flags
+
+	// the config file fills in whatever wasn't given on the command line
+	if *configFlag != "" {
+		if err := loadConfig(*configFlag); err != nil {
+			log.Fatalf("reading -config: %v", err)
+		}
+	}
+
+	o := &options{
+		output:   *outputDirectory,
+		template: *outTemplateFlag,
+
+		check:      *checkFlag,
+		onlyBroken: *onlyBrokenFlag,
+		list:       *listChunksFlag,
+		listFormat: *listFormatFlag,
+
+		dryRun:        *dryRunFlag,
+		inPlace:       *inPlaceFlag,
+		force:         *forceFlag,
+		preserveMtime: *preserveMtimeFlag,
+		verifyOutput:  *verifyOutputFlag,
+		dedup:         *dedupFlag,
+		failFast:      *failFastFlag,
+		minSize:       *minSizeFlag,
+
+		lenient:    *lenientFlag,
+		fixCRC:     *fixCRCFlag,
+		readBuffer: *readBufferFlag,
+		maxText:    *maxTextFlag,
+
+		quantize:    *quantizeFlag,
+		trimPalette: *trimPaletteFlag,
+
+		compress: *webpFlag,
+		smallest: *smallestFlag,
+
+		stdout: *stdoutFlag,
+
+		claimed: &claimSet{inputs: map[string]string{}},
+	}
+
+	var ok bool
+	var err error
+	if o.compressor, ok = compressors[*compressorFlag]; !ok {
+		log.Fatalf("unknown compressor %q, pick webp or avif", *compressorFlag)
+	}
+	if *compressorPathFlag != "" {
+		o.compressor.binary = *compressorPathFlag
+	}
+	o.compressor.quality, o.compressor.lossless = *webpQualityFlag, *webpLosslessFlag
+	o.compressor.retries, o.compressor.backoff = *compressRetriesFlag, *compressBackoffFlag
+
+	if o.routes, err = parseRoutes(*routeFlag); err != nil {
+		log.Fatalf("-route: %v", err)
+	}
+	for _, r := range o.routes {
+		o.routesCompress = o.routesCompress || r.compress
+	}
+
+	// fail now rather than on every single file
+	if *webpFlag || o.routesCompress {
+		if _, err := exec.LookPath(o.compressor.binary); err != nil {
+			log.Fatalf("-compress needs %s: %v", o.compressor.binary, err)
+		}
+	}
+
+	if *webpQualityFlag < 0 || *webpQualityFlag > 100 {
+		log.Fatalf("-webp-quality must be between 0 and 100, got %d", *webpQualityFlag)
+	}
+
+	if *smallestFlag && !*webpFlag {
+		log.Fatal("-smallest needs -compress, there's nothing to compare the PNG against")
+	}
+
+	if *compressRetriesFlag < 0 || *compressBackoffFlag < 0 {
+		log.Fatal("-compress-retries and -compress-backoff can't be negative")
+	}
+
+	if isFlagSet("keep") && isFlagSet("strip") {
+		log.Fatal("-keep and -strip can't be used together")
+	}
+
+	if *quietFlag && *verboseFlag {
+		log.Fatal("-quiet and -verbose can't be used together")
+	}
+	if *quietFlag {
+		level = quiet
+	} else if *verboseFlag {
+		level = verbose
+	}
+
+	if *listFormatFlag != "table" && *listFormatFlag != "json" {
+		log.Fatalf("unknown -list-format %q, pick table or json", *listFormatFlag)
+	}
+
+	if *quantizeFlag != 0 && (*quantizeFlag < 2 || *quantizeFlag > 256) {
+		log.Fatalf("-quantize must be between 2 and 256, got %d", *quantizeFlag)
+	}
+
+	if err = checkTemplate(*outTemplateFlag); err != nil {
+		log.Fatalf("-out-template: %v", err)
+	}
+	if *inPlaceFlag && isFlagSet("out-template") {
+		log.Fatal("-in-place can't be used with -out-template, each input is its own output")
+	}
+
+	if *sampleFlag <= 0 || *sampleFlag > 1 {
+		log.Fatalf("-sample must be above 0 and at most 1, got %v", *sampleFlag)
+	}
+
+	if *onlyBrokenFlag && !*checkFlag {
+		log.Fatal("-only-broken needs -check")
+	}
+
+	if *stdoutFlag && !*stdinFlag {
+		log.Fatal("-stdout needs -stdin, there's only one output to write")
+	}
+
+	// keep the image on stdout clean of anything else
+	if *stdoutFlag {
+		messages = os.Stderr
+	}
+
+	// compressing changes the extension, there's nothing to replace in place
+	if *inPlaceFlag && (*webpFlag || o.routesCompress || *stdinFlag) {
+		log.Fatal("-in-place can't be used with -compress, a -route that compresses or -stdin")
+	}
+
+	// linking would tie the originals themselves together, an edit to one changing them all
+	if *inPlaceFlag && *dedupFlag {
+		log.Fatal("-dedup can't be used with -in-place")
+	}
+
+	if *stampFlag != "" {
+		i := strings.Index(*stampFlag, "=")
+		if i < 0 {
+			log.Fatalf("-stamp must look like key=value, got %q", *stampFlag)
+		}
+		o.stampKeyword, o.stampText = (*stampFlag)[:i], (*stampFlag)[i+1:]
+
+		// catch a bad keyword before every single file fails on it
+		if err := (&PNG{Chunks: map[string][]*Chunk{}}).AddText(o.stampKeyword, o.stampText); err != nil {
+			log.Fatalf("-stamp: %v", err)
+		}
+	}
+
+	// anything bigger would be cut down to its low 32 bits
+	if *maxChunkFlag == 0 || *maxChunkFlag > math.MaxUint32 {
+		log.Fatalf("-max-chunk must be between 1 and %d, got %d", uint32(math.MaxUint32), *maxChunkFlag)
+	}
+	o.maxChunk = uint32(*maxChunkFlag)
+
+	if *maxTextFlag <= 0 {
+		log.Fatalf("-max-text must be above 0, got %d", *maxTextFlag)
+	}
+
+	// the default -keep keeps PLTE and tRNS so palette and grayscale transparency survive, on top of
+	// whatever the safe-to-copy bits allow. Naming the chunks to keep makes it a strict whitelist.
+	o.stripOptions = StripOptions{
+		Keep:           parseChunkList(*keepFlag),
+		KeepSafeToCopy: !isFlagSet("keep"),
+		Check:          *checkFlag,
+
+		DropCorrupt: *lenientFlag,
+		MergeIDAT:   *mergeIDATFlag,
+	}
+	if isFlagSet("strip") {
+		o.stripOptions.Strip = parseChunkList(*stripFlag)
+	}
+
+	if *keepAPNGFlag {
+		o.stripOptions.KeepAll(apngChunks...)
+	}
+
+	if *keepColorFlag {
+		o.stripOptions.KeepAll(colorChunks...)
+	}
+
+	if *keepPhysFlag {
+		o.stripOptions.KeepAll("pHYs")
+	}
+
+	keeping := *keepFlag
+	if o.stripOptions.KeepSafeToCopy {
+		keeping += " and safe-to-copy chunks"
+	}
+
+	logf("input directory: %s, output directory: %s, goroutine count: %d\ncompress to webp: %t, integrity check: %t, keeping: %s",
+		*inputDirectory, *outputDirectory, *routinesFlag, *webpFlag, *checkFlag, keeping)
+	return o
+}
+
+// messages is where per file output goes, stderr when the image itself is written to stdout
+var messages io.Writer = os.Stdout
+
+// errStopWalk ends the walk early once -max-files have been queued
+var errStopWalk = errors.New("reached -max-files")
+
+// routineCount is the value of -routines, accepting auto or 0 for one goroutine per CPU
+type routineCount int
+
+// routinesVar defines a routineCount flag
+func routinesVar(name string, value int, usage string) *routineCount {
+	r := routineCount(value)
+	flag.Var(&r, name, usage)
+	return &r
+}
+
+func (r *routineCount) String() string {
+	return strconv.Itoa(int(*r))
+}
+
+func (r *routineCount) Set(value string) error {
+	n := 0
+	if value != "auto" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("expected a number of goroutines or auto, got %q", value)
+		}
+	}
+
+	if n == 0 {
+		n = runtime.NumCPU()
+	}
+	*r = routineCount(n)
+	return nil
+}
+
+// isFlagSet reports whether the named flag was passed on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// parseChunkList turns a comma separated list of chunk types into a set
+func parseChunkList(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, chunkType := range strings.Split(list, ",") {
+		if chunkType = strings.TrimSpace(chunkType); chunkType != "" {
+			set[chunkType] = true
+		}
+	}
+	return set
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// savings tracks the size of the inputs against the stripped outputs across all workers
+type savings struct {
+	sync.Mutex
+	files    int
+	original int64
+	stripped int64
+}
+
+// add records a processed file
+func (s *savings) add(original, stripped int64) {
+	s.Lock()
+	s.files++
+	s.original += original
+	s.stripped += stripped
+	s.Unlock()
+}
+
+func (s *savings) String() string {
+	s.Lock()
+	defer s.Unlock()
+
+	saved := s.original - s.stripped
+	percent := 0.0
+	if s.original > 0 {
+		percent = float64(saved) / float64(s.original) * 100
+	}
+	return fmt.Sprintf("%d files, %s -> %s, saved %s (%.1f%%)",
+		s.files, formatBytes(s.original), formatBytes(s.stripped), formatBytes(saved), percent)
+}
+
+// metrics works out the throughput of the files recorded over elapsed, bytes counting the inputs read
+func (s *savings) metrics(elapsed time.Duration) metrics {
+	s.Lock()
+	defer s.Unlock()
+
+	m := metrics{Files: s.files, OriginalBytes: s.original, StrippedBytes: s.stripped, Seconds: elapsed.Seconds()}
+	if m.Seconds > 0 {
+		m.FilesPerSecond = float64(s.files) / m.Seconds
+		m.BytesPerSecond = float64(s.original) / m.Seconds
+	}
+	return m
+}
+
+var totals savings
+
+// chunkTotal is how many chunks of one type were removed and the bytes they took up
+type chunkTotal struct {
+	chunkType string
+	chunks    int
+	bytes     int64
+}
+
+// chunkTotals adds up the chunks removed from every file by type, for -stats-per-chunk-type
+type chunkTotals struct {
+	sync.Mutex
+	types map[string]*chunkTotal
+}
+
+// add records the chunks stripping removes from png
+func (t *chunkTotals) add(png *PNG, opts StripOptions) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.types == nil {
+		t.types = map[string]*chunkTotal{}
+	}
+
+	for _, chunk := range png.chunks() {
+		if opts.KeepsChunk(chunk) {
+			continue
+		}
+
+		total, ok := t.types[chunk.Type]
+		if !ok {
+			total = &chunkTotal{chunkType: chunk.Type}
+			t.types[chunk.Type] = total
+		}
+		total.chunks++
+		total.bytes += chunkOverhead + int64(len(chunk.Data))
+	}
+}
+
+// sorted lists the totals with the most bytes removed first
+func (t *chunkTotals) sorted() []*chunkTotal {
+	t.Lock()
+	defer t.Unlock()
+
+	totals := make([]*chunkTotal, 0, len(t.types))
+	for _, total := range t.types {
+		totals = append(totals, total)
+	}
+
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].bytes != totals[j].bytes {
+			return totals[i].bytes > totals[j].bytes
+		}
+		return totals[i].chunkType < totals[j].chunkType
+	})
+	return totals
+}
+
+var removedByType chunkTotals
+
+// belowMinSize counts the files copied as is because they're smaller than -min-size
+var belowMinSize int64
+
+// brokenFiles counts the files -only-broken found damaged
+var brokenFiles int64
+
+// formatBytes prints a byte count with a human friendly unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	value, suffix := float64(n), 0
+	for ; (value >= unit || value <= -unit) && suffix < 3; suffix++ {
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f%cB", value, "KMGT"[suffix-1])
+}
+
+// removedChunks lists the types of the chunks strip throws away, in file order
+func removedChunks(png *PNG, opts StripOptions) []string {
+	var removed []string
+	for _, chunk := range png.chunks() {
+		if !opts.KeepsChunk(chunk) {
+			removed = append(removed, chunk.Type)
+		}
+	}
+	return removed
+}
+
+// logChunkDecisions logs what stripping does with every chunk of png, for -verbose
+func logChunkDecisions(path string, png *PNG, opts StripOptions) {
+	if level < verbose {
+		return
+	}
+
+	for i, chunk := range png.chunks() {
+		action := "dropping"
+		if opts.KeepsChunk(chunk) {
+			action = "keeping"
+		}
+		debugf("%s: %s chunk %d %s (%d bytes)", path, action, i, chunk.Type, len(chunk.Data))
+	}
+}
+
+// dryRun reports which chunks strip would throw away from png and how big the output would be
+func dryRun(png *PNG, path string, opts StripOptions) int64 {
+	var removed []string
+	removedBytes := map[string]int{}
+	size := len(PNGHeader)
+
+	order := png.chunks()
+	for i, chunk := range order {
+		n := chunkOverhead + len(chunk.Data)
+		if opts.KeepsChunk(chunk) {
+			// a merged IDAT only pays for its header once
+			if opts.MergeIDAT && chunk.Type == "IDAT" && i > 0 && order[i-1].Type == "IDAT" {
+				n -= chunkOverhead
+			}
+			size += n
+			continue
+		}
+
+		if _, ok := removedBytes[chunk.Type]; !ok {
+			removed = append(removed, chunk.Type)
+		}
+		removedBytes[chunk.Type] += n
+	}
+
+	saved := 0
+	summary := make([]string, len(removed))
+	for i, chunkType := range removed {
+		saved += removedBytes[chunkType]
+		summary[i] = fmt.Sprintf("%s (%d bytes)", chunkType, removedBytes[chunkType])
+	}
+
+	if len(removed) == 0 {
+		printf("%s: nothing to strip, output would be %d bytes\n", path, size)
+	} else {
+		printf("%s: would strip %s, output would be %d bytes, saving %d of %d ancillary bytes\n",
+			path, strings.Join(summary, ", "), size, saved, png.AncillaryBytes())
+	}
+	return int64(size)
+}
+
+// readInput parses the input, in -lenient mode logging the damage it recovers from
+func (o *options) readInput(f io.Reader, path string) (*PNG, error) {
+	opts := ReadOptions{FixCRC: o.fixCRC, BufferSize: o.readBuffer, MaxChunkLength: o.maxChunk, CountTrailing: true}
+	if !o.lenient {
+		png, err := ReadWithOptions(f, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return png, nil
+	}
+
+	png, errs := ReadLenient(f, opts)
+	if png == nil {
+		return nil, fmt.Errorf("%s: %w", path, errs[0])
+	}
+
+	// only ancillary chunks can be dropped, writing a damaged critical one out under a fresh CRC
+	// would pass the damage on as if it were intact
+	offsets := chunkOffsets(png.Order)
+	for i, chunk := range png.Order {
+		if !chunk.IsCritical() {
+			continue
+		}
+		if _, err := chunk.Verify(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, &ChunkError{Type: chunk.Type, Index: i, Offset: offsets[i], Err: err})
+		}
+	}
+
+	for _, err := range errs {
+		logf("recovering %s: %v", path, err)
+	}
+
+	if png.MissingIEND {
+		// an IEND only salvages the file when the image data came through whole
+		if err := png.completeImageData(); err != nil {
+			return nil, fmt.Errorf("%s: can't add the missing IEND: %w", path, err)
+		}
+
+		logf("recovering %s: adding the missing IEND", path)
+		png.AddIEND()
+
+		// what's left still has to be an image
+		for _, err := range png.Validate() {
+			if errors.Is(err, ErrorMissingChunk) {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return png, nil
+}
+
+// checkInput reads the input for -check. It carries on past damage the way -lenient does so every
+// problem in the file gets reported, not just the first one, and fails the file if there are any.
+func (o *options) checkInput(f io.Reader, path string) (*PNG, error) {
+	opts := ReadOptions{FixCRC: o.fixCRC, BufferSize: o.readBuffer, MaxChunkLength: o.maxChunk, CountTrailing: true}
+	png, errs := ReadLenient(f, opts)
+	if png == nil {
+		return nil, fmt.Errorf("%s: %w", path, errs[0])
+	}
+
+	var problems []error
+	for _, err := range errs {
+		// the chunks are kept, Verify finds their CRCs again
+		if !errors.Is(err, ErrorCRCMismatch) {
+			problems = append(problems, err)
+		}
+	}
+
+	if err := png.Verify(); err != nil {
+		problems = append(problems, err.(*VerifyError).Errs...)
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s: %w", path, &VerifyError{Errs: problems})
+	}
+	return png, nil
+}
+
+// stamp adds the -stamp text to the stripped image in buf. It goes in after stripping so neither
+// -keep nor -strip can throw it away again.
+func (o *options) stamp(buf *bytes.Buffer) error {
+	stripped, err := ReadWithOptions(bytes.NewReader(buf.Bytes()), ReadOptions{MaxChunkLength: o.maxChunk})
+	if err != nil {
+		return err
+	}
+
+	if err = stripped.AddText(o.stampKeyword, o.stampText); err != nil {
+		return err
+	}
+
+	buf.Reset()
+	_, err = stripped.WriteTo(buf)
+	return err
+}
+
+// prepare reads the input and applies everything that runs before stripping
+func (o *options) prepare(f io.Reader, path string) (*PNG, error) {
+	read := o.readInput
+	if o.check {
+		read = o.checkInput
+	}
+
+	png, err := read(f, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// appended data is how polyglot files smuggle a second payload in
+	if png.TrailingBytes > 0 {
+		logf("%s: dropping %d bytes after IEND", path, png.TrailingBytes)
+	}
+
+	if o.check {
+		o.printTextMetadata(path, png)
+	}
+
+	if o.quantize > 0 {
+		if err := png.Quantize(o.quantize); err != nil {
+			logf("not quantizing %s: %v", path, err)
+		}
+	}
+
+	if o.trimPalette {
+		if err := png.TrimPalette(); err != nil {
+			logf("not trimming the palette of %s: %v", path, err)
+		}
+	}
+	return png, nil
+}
+
+// process strips a single input file, filling in res as it goes
+func (o *options) process(ctx context.Context, j job, res *result) error {
+	path := j.path
+
+	// only hold the file open while it's being worked on
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("skipping %s: %w", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	res.OriginalSize = info.Size()
+
+	input, gzipped, err := decompress(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if o.list {
+		return o.listChunks(input, path)
+	}
+
+	if climbs(j.rel) {
+		return fmt.Errorf("%s: %s is outside the directory walked, its output would be outside %s", path, j.rel, o.output)
+	}
+
+	// copies of the input as it is keep its name
+	p := filepath.Join(o.output, expandTemplate(o.template, j.rel))
+	if !o.inPlace {
+		if err := refuseInput(p, info); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if o.onlyBroken {
+		if err := o.claim(p, path); err != nil {
+			return err
+		}
+		return o.quarantine(f, input, path, p, info, res)
+	}
+
+	if o.inPlace {
+		if gzipped {
+			return fmt.Errorf("%s: can't strip a gzipped file in place", path)
+		}
+		p = path
+	}
+
+	if info.Size() < o.minSize {
+		atomic.AddInt64(&belowMinSize, 1)
+		res.Status = statusSkipped
+		// the original already is the untouched copy
+		if o.dryRun || o.inPlace {
+			return nil
+		}
+
+		if err := o.claim(p, path); err != nil {
+			return err
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		if err := copyFile(f, p); err != nil {
+			return err
+		}
+		res.Output, res.StrippedSize = p, info.Size()
+
+		if o.preserveMtime {
+			return os.Chtimes(p, info.ModTime(), info.ModTime())
+		}
+		return nil
+	}
+
+	// the stripped output of a .png.gz is a plain PNG, claiming it fails whichever of a.png and
+	// a.png.gz comes second when the run has both
+	if gzipped && !o.inPlace {
+		p = filepath.Join(o.output, expandTemplate(o.template, strings.TrimSuffix(j.rel, ".gz")))
+		if err := refuseInput(p, info); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := o.claim(p, path); err != nil {
+		return err
+	}
+
+	// with -preserve-mtime the output has the same mtime as its input, so that counts as up to date.
+	// An old output says nothing about the input's integrity, so checks always read it.
+	if !o.force && !o.dryRun && !o.inPlace && !o.check && !o.verifyOutput {
+		outputs := []string{p}
+		if o.compress || o.routesCompress {
+			outputs[0] = strings.TrimSuffix(p, filepath.Ext(p)) + o.compressor.extension
+		}
+		// -smallest may have kept the PNG last time, and -route can send it either way
+		if o.smallest || len(o.routes) > 0 {
+			outputs = append(outputs, p)
+		}
+
+		for _, output := range outputs {
+			if existing, err := os.Stat(output); err == nil && !existing.ModTime().Before(info.ModTime()) {
+				res.Status, res.Output, res.StrippedSize = statusSkipped, output, existing.Size()
+				printf("%s: %s is up to date, skipping\n", path, output)
+				return nil
+			}
+		}
+	}
+
+	png, err := o.prepare(input, path)
+	if err != nil {
+		return err
+	}
+
+	res.ChunksRemoved = removedChunks(png, o.stripOptions)
+	res.TrailingBytes = png.TrailingBytes
+	logChunkDecisions(path, png, o.stripOptions)
+
+	if o.dryRun {
+		res.Status = statusSkipped
+		res.StrippedSize = dryRun(png, path, o.stripOptions)
+		totals.add(res.OriginalSize, res.StrippedSize)
+		removedByType.add(png, o.stripOptions)
+		return nil
+	}
+
+	var output string
+	var size int64
+	compress := routeCompresses(png, o.routes, o.compress)
+	if !gzipped && o.copyable(png, compress) {
+		// already minimal files come out byte for byte the same, so copy them instead of rebuilding them
+		debugf("%s: nothing to strip, copying it as is", path)
+		if output, size, err = o.copyInput(f, p); err != nil {
+			return err
+		}
+	} else if output, size, err = o.strip(ctx, png, p, compress, o.stripOptions); err != nil {
+		var checksumErr *ChecksumError
+		if errors.As(err, &checksumErr) {
+			checksumErr.Path = path
+			return checksumErr
+		}
+		return err
+	}
+	res.Output, res.StrippedSize = output, size
+
+	if o.preserveMtime {
+		if err = os.Chtimes(output, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	totals.add(info.Size(), size)
+	removedByType.add(png, o.stripOptions)
+	printf("%s: %s -> %s\n", path, formatBytes(info.Size()), formatBytes(size))
+	return nil
+}
+
+// refuseInput fails when output is the input itself, writing it would destroy the input before
+// it's been read
+func refuseInput(output string, input os.FileInfo) error {
+	if existing, err := os.Stat(output); err == nil && os.SameFile(existing, input) {
+		return fmt.Errorf("%s would be its own output, pick another -output or use -in-place", output)
+	}
+	return nil
+}
+
+// claimSet records the input each output of the run belongs to
+type claimSet struct {
+	sync.Mutex
+	inputs map[string]string
+}
+
+// claim makes output the output of input, failing when another input of the run already has it.
+// Inputs of the same name under an -out-template without {dir}, or named on the command line from
+// different directories, would otherwise overwrite each other, whichever finishes last winning.
+func (o *options) claim(output, input string) error {
+	o.claimed.Lock()
+	defer o.claimed.Unlock()
+
+	output = filepath.Clean(output)
+	if other, ok := o.claimed.inputs[output]; ok && other != input {
+		return fmt.Errorf("%s: %s is already the output of %s", input, output, other)
+	}
+	o.claimed.inputs[output] = input
+	return nil
+}
+
+// quarantine copies f to its output path untouched when input, the PNG it holds, fails
+// verification, and leaves it alone when it's intact
+func (o *options) quarantine(f *os.File, input io.Reader, path, output string, info os.FileInfo, res *result) error {
+	failure := Verify(input)
+	if failure == nil {
+		res.Status = statusSkipped
+		debugf("%s: passes the check, skipping", path)
+		return nil
+	}
+	atomic.AddInt64(&brokenFiles, 1)
+	res.Status, res.Error = statusBroken, failure.Error()
+
+	printf("%s: %v, copying it to %s\n", path, failure, output)
+	if o.dryRun {
+		return nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := copyFile(f, output); err != nil {
+		return err
+	}
+	res.Output, res.StrippedSize = output, info.Size()
+
+	if o.preserveMtime {
+		return os.Chtimes(output, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// pipe strips the PNG on stdin, writing it to stdout with -stdout or into the output directory otherwise
+func (o *options) pipe(ctx context.Context) error {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	png, err := o.prepare(bytes.NewReader(data), "stdin")
+	if err != nil {
+		return err
+	}
+	logChunkDecisions("stdin", png, o.stripOptions)
+
+	if o.dryRun {
+		dryRun(png, "stdin", o.stripOptions)
+		return nil
+	}
+
+	compress := routeCompresses(png, o.routes, o.compress)
+	if !o.stdout {
+		output, size, err := o.strip(ctx, png, filepath.Join(o.output, "stdin.png"), compress, o.stripOptions)
+		if err != nil {
+			return err
+		}
+		printf("stdin: %s -> %s (%s)\n", formatBytes(int64(len(data))), formatBytes(size), output)
+		return nil
+	}
+
+	var byteBuf bytes.Buffer
+	if err := Strip(png, &byteBuf, o.stripOptions); err != nil {
+		return fmt.Errorf("stdin: %w", err)
+	}
+
+	if o.stampKeyword != "" {
+		if err := o.stamp(&byteBuf); err != nil {
+			return fmt.Errorf("stdin: %w", err)
+		}
+	}
+	stripped := byteBuf.Bytes()
+
+	if o.verifyOutput {
+		if err := verifyDecodes(bytes.NewReader(stripped)); err != nil {
+			return fmt.Errorf("stdin: %w", err)
+		}
+	}
+
+	if compress {
+		// the compressors only write files, so go through a scratch directory
+		dir, err := ioutil.TempDir("", "strip")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		output := filepath.Join(dir, "stdin"+o.compressor.extension)
+		if err := o.compressor.compressRetrying(ctx, stripped, output); err != nil {
+			return err
+		}
+
+		compressed, err := ioutil.ReadFile(output)
+		if err != nil {
+			return err
+		}
+
+		if !o.smallest || len(compressed) < len(stripped) {
+			stripped = compressed
+		}
+	}
+
+	if _, err := os.Stdout.Write(stripped); err != nil {
+		return err
+	}
+	printf("stdin: %s -> %s\n", formatBytes(int64(len(data))), formatBytes(int64(len(stripped))))
+	return nil
+}
+
+// chunkListing is one chunk of the -list-chunks output
+type chunkListing struct {
+	Type     string `json:"type"`
+	Length   uint32 `json:"length"`
+	Offset   int64  `json:"offset"`
+	CRCValid bool   `json:"crc_valid"`
+}
+
+// listChunks prints the chunk inventory of the input, reading leniently so damaged chunks show up too
+func (o *options) listChunks(f io.Reader, path string) error {
+	png, errs := ReadLenient(f, ReadOptions{BufferSize: o.readBuffer, MaxChunkLength: o.maxChunk})
+	if png == nil {
+		return fmt.Errorf("%s: %w", path, errs[0])
+	}
+
+	chunks := make([]chunkListing, len(png.Order))
+	offsets := chunkOffsets(png.Order)
+	for i, chunk := range png.Order {
+		_, err := chunk.Verify()
+		chunks[i] = chunkListing{Type: chunk.Type, Length: chunk.Length, Offset: offsets[i], CRCValid: err == nil}
+	}
+
+	problems := make([]string, len(errs))
+	for i, err := range errs {
+		problems[i] = err.Error()
+	}
+
+	// build each listing whole so output from other workers doesn't interleave
+	var listing strings.Builder
+	if o.listFormat == "json" {
+		data, err := json.Marshal(struct {
+			File   string         `json:"file"`
+			Chunks []chunkListing `json:"chunks"`
+			Errors []string       `json:"errors,omitempty"`
+		}{path, chunks, problems})
+		if err != nil {
+			return err
+		}
+		listing.Write(data)
+		listing.WriteByte('\n')
+	} else {
+		fmt.Fprintf(&listing, "%s:\n", path)
+		w := tabwriter.NewWriter(&listing, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "  TYPE\tLENGTH\tOFFSET\tCRC")
+		for _, chunk := range chunks {
+			crc := "ok"
+			if !chunk.CRCValid {
+				crc = "bad"
+			}
+			fmt.Fprintf(w, "  %s\t%d\t%d\t%s\n", chunk.Type, chunk.Length, chunk.Offset, crc)
+		}
+		w.Flush()
+
+		for _, problem := range problems {
+			fmt.Fprintf(&listing, "  error: %s\n", problem)
+		}
+	}
+
+	fmt.Fprint(messages, listing.String())
+	return nil
+}
+
+// dirSet records the output directories a run created, so -prune-empty-output-dirs never
+// touches the ones that were there before
+type dirSet struct {
+	sync.Mutex
+	created map[string]bool
+}
 
-	routinesFlag = flag.Int("routines", 16, "the amount of go routines to spawn")
-)
+var outputDirs = dirSet{created: map[string]bool{}}
 
-func init() {
-	flag.Parse() // our flags
+// mkdir creates dir and whatever parents it's missing, remembering the ones it made
+func (s *dirSet) mkdir(dir string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var missing []string
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || filepath.Dir(d) == d {
+			break
+		}
+		missing = append(missing, d)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
 
-	log.Printf("input directory: %s, output directory: %s, goroutine count: %d\ncompress to webp: %t, integrity check: %t",
-		*inputDirectory, *outputDirectory, *routinesFlag, *webpFlag, *checkFlag)
+	for _, d := range missing {
+		s.created[d] = true
+	}
+	return nil
 }
 
-func max(a, b int) int {
-	if a > b {
-		return a
+// prune removes the created directories left empty, deepest first so emptied parents go too,
+// returning how many it removed
+func (s *dirSet) prune() (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	dirs := make([]string, 0, len(s.created))
+	for dir := range s.created {
+		dirs = append(dirs, dir)
 	}
-	return b
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+
+	removed := 0
+	for _, dir := range dirs {
+		names, err := readDirNames(dir)
+		if err != nil {
+			return removed, err
+		}
+		if len(names) > 0 {
+			continue
+		}
+
+		if err = os.Remove(dir); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// copyFile copies the input to output unchanged
+func copyFile(input io.Reader, output string) error {
+	if err := outputDirs.mkdir(filepath.Dir(output)); err != nil {
+		return err
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, input); err != nil {
+		f.Close()
+		os.Remove(output)
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		os.Remove(output)
+		return err
+	}
+	return nil
+}
+
+// copyable reports whether stripping png would write back exactly the bytes it was read from.
+// Anything that rewrites chunks, and the outputs that aren't a plain file, rule that out.
+func (o *options) copyable(png *PNG, compress bool) bool {
+	if compress || o.inPlace || o.dedup || o.stampKeyword != "" || o.quantize > 0 || o.trimPalette {
+		return false
+	}
+
+	// a fixed CRC or salvaged chunk list differs from the input even when every chunk is kept
+	if o.fixCRC || o.lenient || o.stripOptions.Check || png.TrailingBytes > 0 || png.MissingIEND {
+		return false
+	}
+	return o.stripOptions.KeepsAll(png)
+}
+
+// copyInput copies the already read input to output, returning the path and size of the file written
+func (o *options) copyInput(input io.ReadSeeker, output string) (string, int64, error) {
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+
+	if err := copyFile(input, output); err != nil {
+		return "", 0, err
+	}
+
+	if o.verifyOutput {
+		if err := verifyFile(output); err != nil {
+			os.Remove(output)
+			return "", 0, fmt.Errorf("%s: %w", output, err)
+		}
+	}
+
+	info, err := os.Stat(output)
+	if err != nil {
+		return "", 0, err
+	}
+	return output, info.Size(), nil
 }
 
-func strip(png *PNG, output string, compress, check bool) error {
+// strip writes the stripped png to output, returning the path and size of the file written.
+// Compressing swaps the extension of output for the compressor's.
+func (o *options) strip(ctx context.Context, png *PNG, output string, compress bool, opts StripOptions) (string, int64, error) {
 	var byteBuf bytes.Buffer
 
-	byteBuf.Write(PNGHeader)
+	if err := Strip(png, &byteBuf, opts); err != nil {
+		return "", 0, fmt.Errorf("%s: %w", output, err)
+	}
 
-	png.Chunks["IHDR"][0].Write(&byteBuf)
+	if o.stampKeyword != "" {
+		if err := o.stamp(&byteBuf); err != nil {
+			return "", 0, fmt.Errorf("%s: %w", output, err)
+		}
+	}
 
-	for _, chunks := range png.Chunks {
-		for _, chunk := range chunks {
-			// throw away all ancillary chunks
-			if chunk.Type == "IDAT" || chunk.Type == "PLTE" {
-
-				if check {
-					_, err := chunk.Verify()
-					if err != nil {
-						// failed a checksum
-						return errors.New(fmt.Sprintf("%s failed checksum", output))
+	// last chance to bail out before touching the disk
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+
+	// the output tree might not exist yet on a fresh checkout
+	if err := outputDirs.mkdir(filepath.Dir(output)); err != nil {
+		return "", 0, err
+	}
+
+	pngOutput := output
+	if compress {
+		output = strings.TrimSuffix(output, filepath.Ext(output)) + o.compressor.extension
+	}
+
+	var claim *hashEntry
+	if o.dedup {
+		entry, first := outputHashes.claim(sha256.Sum256(byteBuf.Bytes()), output)
+
+		// an identical image is already being written, point at it rather than storing it again
+		if !first && entry.wait() {
+			// with -smallest the first copy may have been kept as a PNG, link under its extension
+			output = strings.TrimSuffix(output, filepath.Ext(output)) + filepath.Ext(entry.path)
+			err := linkFile(entry.path, output)
+			if err == nil {
+				if o.verifyOutput {
+					if err = o.verifyLinked(output, byteBuf.Bytes()); err != nil {
+						os.Remove(output)
+						return "", 0, fmt.Errorf("%s: %w", output, err)
 					}
 				}
+				atomic.AddInt64(&linkedDuplicates, 1)
 
-				chunk.Write(&byteBuf)
+				info, err := os.Stat(output)
+				if err != nil {
+					return "", 0, err
+				}
+				return output, info.Size(), nil
 			}
+			logf("writing %s instead of linking it to %s: %v", output, entry.path, err)
 		}
-	}
 
-	png.Chunks["IEND"][0].Write(&byteBuf)
+		if first {
+			claim = entry
+			// unblock the duplicates waiting on us however this ends
+			defer func() { claim.finish(false) }()
+		}
+	}
 
+	size := int64(byteBuf.Len())
 	if compress {
-		output = output[:strings.LastIndex(output, ".")] + ".webp"
+		// the compressed formats can't be decoded here, check what goes into the compressor instead
+		if o.verifyOutput {
+			if err := verifyDecodes(bytes.NewReader(byteBuf.Bytes())); err != nil {
+				return "", 0, fmt.Errorf("%s: %w", output, err)
+			}
+		}
 
-		temp, err := ioutil.TempFile("", "strip-*.png")
+		if err := o.compressor.compressRetrying(ctx, byteBuf.Bytes(), output); err != nil {
+			os.Remove(output)
+			return "", 0, err
+		}
 
+		info, err := os.Stat(output)
 		if err != nil {
-			return err
+			return "", 0, err
 		}
+		size = info.Size()
 
-		temp.Write(byteBuf.Bytes())
-		temp.Close()
-
-		cmd := exec.Command("cwebp", "-lossless", temp.Name(), "-o", output)
+		if o.smallest && size >= int64(byteBuf.Len()) {
+			debugf("%s: keeping the PNG, %s is %s", pngOutput, output, formatBytes(size))
+			if err = os.Remove(output); err != nil {
+				return "", 0, err
+			}
 
-		if err = cmd.Start(); err != nil {
-			return err
+			output, size = pngOutput, int64(byteBuf.Len())
+			if err = ioutil.WriteFile(output, byteBuf.Bytes(), 0644); err != nil {
+				os.Remove(output)
+				return "", 0, err
+			}
+		}
+	} else if o.inPlace {
+		if err := o.replaceFile(output, byteBuf.Bytes()); err != nil {
+			return "", 0, fmt.Errorf("%s: %w", output, err)
 		}
 	} else {
 		f, err := os.Create(output)
 
 		if err != nil {
+			return "", 0, err
+		}
+
+		// never leave a half written file behind
+		if _, err = f.Write(byteBuf.Bytes()); err != nil {
+			f.Close()
+			os.Remove(output)
+			return "", 0, err
+		}
+
+		if err = f.Close(); err != nil {
+			os.Remove(output)
+			return "", 0, err
+		}
+
+		if o.verifyOutput {
+			if err = verifyFile(output); err != nil {
+				os.Remove(output)
+				return "", 0, fmt.Errorf("%s: %w", output, err)
+			}
+		}
+	}
+
+	if claim != nil {
+		claim.path = output
+		claim.finish(true)
+	}
+	return output, size, nil
+}
+
+// hashIndex maps the hash of each stripped image to the first output written with it
+type hashIndex struct {
+	sync.Mutex
+	entries map[[sha256.Size]byte]*hashEntry
+}
+
+// hashEntry is the output claimed for a hash, done is closed once it has been written or given up on
+type hashEntry struct {
+	path    string
+	done    chan struct{}
+	once    sync.Once
+	written bool
+}
+
+// claim returns the entry for sum, creating it for path when this is the first time sum is seen
+func (h *hashIndex) claim(sum [sha256.Size]byte, path string) (*hashEntry, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	if entry, ok := h.entries[sum]; ok {
+		return entry, false
+	}
+
+	entry := &hashEntry{path: path, done: make(chan struct{})}
+	h.entries[sum] = entry
+	return entry, true
+}
+
+// finish records whether the output was written and releases anyone waiting, only the first call counts
+func (e *hashEntry) finish(written bool) {
+	e.once.Do(func() {
+		e.written = written
+		close(e.done)
+	})
+}
+
+// wait blocks until the first output is done, reporting whether it exists to link to
+func (e *hashEntry) wait() bool {
+	<-e.done
+	return e.written
+}
+
+var outputHashes = hashIndex{entries: map[[sha256.Size]byte]*hashEntry{}}
+
+// linkedDuplicates counts the outputs -dedup hard linked to an identical earlier one
+var linkedDuplicates int64
+
+// linkFile hard links output to existing, replacing whatever is at output
+func linkFile(existing, output string) error {
+	tmp := filepath.Join(filepath.Dir(output), ".strip-"+filepath.Base(output)+".link")
+	os.Remove(tmp)
+
+	if err := os.Link(existing, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, output); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// verifyLinked checks an output -dedup linked to an earlier one, stripped being the image it
+// stands for. A compressed copy can't be decoded here, so like the first one it's the PNG that
+// went into the compressor that gets checked.
+func (o *options) verifyLinked(output string, stripped []byte) error {
+	if filepath.Ext(output) == o.compressor.extension {
+		return verifyDecodes(bytes.NewReader(stripped))
+	}
+	return verifyFile(output)
+}
+
+// replaceFile writes data next to path and renames it over path, so an interrupted run never
+// leaves a half written original behind. path is left untouched on any error.
+func (o *options) replaceFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".strip-*.tmp")
+	if err != nil {
+		return err
+	}
+	name := tmp.Name()
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(name)
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	// TempFile creates the file private to us, keep the original's permissions
+	if err = os.Chmod(name, info.Mode().Perm()); err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	if o.verifyOutput {
+		if err = verifyFile(name); err != nil {
+			os.Remove(name)
 			return err
 		}
+	}
 
-		f.Write(byteBuf.Bytes())
-		f.Close()
+	if err = os.Rename(name, path); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// verifyFile re-reads a written output to make sure it decodes
+func verifyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return verifyDecodes(f)
+}
+
+// verifyDecodes decodes the whole image with image/png, catching outputs that are well formed
+// chunk by chunk but still broken
+func verifyDecodes(r io.Reader) error {
+	if _, err := imagepng.Decode(r); err != nil {
+		return fmt.Errorf("stripped image doesn't decode: %w", err)
 	}
 	return nil
 }
 
+// printTextMetadata prints the text chunks of a PNG, handy for spotting anything
+// that shouldn't have been left in an exported image
+func (o *options) printTextMetadata(path string, png *PNG) {
+	metadata, err := png.TextMetadataWithOptions(TextOptions{MaxTextLength: o.maxText})
+	if err != nil {
+		printf("bad text metadata in %s: %v\n", path, err)
+		return
+	}
+
+	if len(metadata) == 0 {
+		return
+	}
+
+	keywords := make([]string, 0, len(metadata))
+	for keyword := range metadata {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+
+	// build the whole listing first so output from other workers doesn't interleave
+	var listing strings.Builder
+	fmt.Fprintf(&listing, "text metadata in %s:\n", path)
+	for _, keyword := range keywords {
+		fmt.Fprintf(&listing, "  %s: %s\n", keyword, metadata[keyword])
+	}
+	printf("%s", listing.String())
+}
+
+// counters are shared between the workers, the progress reporter and the final summary
+type counters struct {
+	// done and total are the files processed so far and the files queued
+	done, total int64
+	// failed counts the files that errored, any at all fails the run
+	failed int64
+	// walkErrors counts the paths the walk couldn't read, they never became files to count in total
+	// but fail the run too
+	walkErrors int64
+}
+
+// job is a file queued for the workers, rel is its path below the directory it was found in
+type job struct {
+	path string
+	rel  string
+}
+
+// worker processes the jobs it receives until jobs is closed, sending each result to results
+// when it isn't nil. Once ctx is cancelled whatever is left is drained without being processed.
+func (o *options) worker(ctx context.Context, cancel context.CancelFunc, jobs <-chan job, results chan<- *result, count *counters) {
+	for j := range jobs {
+		if ctx.Err() != nil {
+			continue
+		}
+
+		res := &result{Input: j.path, Status: statusOK}
+		err := o.process(ctx, j, res)
+		if err != nil {
+			res.Status, res.Error = statusError, err.Error()
+		}
+
+		if results != nil {
+			results <- res
+		}
+		atomic.AddInt64(&count.done, 1)
+
+		if err != nil {
+			errorf("%v", err)
+			atomic.AddInt64(&count.failed, 1)
+
+			if o.failFast && ctx.Err() == nil {
+				errorf("stopping after the first failure")
+				cancel()
+			}
+		}
+	}
+}
+
+// reportProgress logs how many of the tasks are done every interval until stop is closed
+func reportProgress(done, total *int64, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			finished, all := atomic.LoadInt64(done), atomic.LoadInt64(total)
+			percent := 100.0
+			if all > 0 {
+				percent = float64(finished) / float64(all) * 100
+			}
+			logf("processed %d/%d (%.1f%%)", finished, all, percent)
+		}
+	}
+}
+
 func main() {
+	opts := setup()
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	var waitGroup sync.WaitGroup
 
-	start := time.Now()
+	// the first SIGINT or SIGTERM lets the files in progress finish, a second one kills us
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	files, _ := ioutil.ReadDir(*inputDirectory)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			logf("received %v, finishing the files in progress", sig)
+			signal.Stop(signals)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	tasks := make(chan func() error, len(files))
+	if *stdinFlag {
+		if err := opts.pipe(ctx); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	filepath.Walk(*inputDirectory, func(path string, info os.FileInfo, err error) error {
-		if strings.HasSuffix(info.Name(), ".png") {
-			f, _ := os.Open(path)
-			tasks <- func() error {
-				png, err := Read(f)
+	// workers start straight away and pick up files as the walk finds them
+	jobs := make(chan job, *routinesFlag)
 
-				if err != nil {
-					if err == ErrorCRCMismatch {
-						fmt.Printf("crc mismatch while reading %s\n", path)
-					}
-					return err
-				}
+	// workers send their results to the -report and -manifest writer
+	var results chan *result
+	var reportWritten <-chan error
+	if *reportFlag != "" || *manifestFlag != "" {
+		results = make(chan *result, *routinesFlag)
+		reportWritten = collectResults(*reportFlag, *manifestFlag, results)
+	}
+
+	var count counters
+	stopProgress := make(chan struct{})
+	if *progressFlag > 0 {
+		go reportProgress(&count.done, &count.total, *progressFlag, stopProgress)
+	}
+
+	// workers are started as files turn up, so a handful of files doesn't get a full pool
+	workers := 0
+	startWorker := func() {
+		waitGroup.Add(1)
+		debugf("starting work group %d", workers)
+		taskID := workers
+		workers++
+		go func() {
+			opts.worker(ctx, cancel, jobs, results, &count)
+			debugf("worker group %d completed", taskID)
+			waitGroup.Done()
+		}()
+	}
+
+	// queueTime is how long the walk spent waiting for a worker to take a file, jobs only holds
+	// -routines of them
+	var queueTime time.Duration
+
+	// submit queues a single file for the workers, returning errStopWalk once -max-files are queued
+	submit := func(path, rel string) error {
+		if *maxFilesFlag > 0 && atomic.LoadInt64(&count.total) >= *maxFilesFlag {
+			return errStopWalk
+		}
+		atomic.AddInt64(&count.total, 1)
+		if workers < int(*routinesFlag) {
+			startWorker()
+		}
+
+		queued := time.Now()
+		defer func() { queueTime += time.Since(queued) }()
+
+		select {
+		case jobs <- job{path: path, rel: rel}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// -sample draws from its own source so a seed always picks the same files
+	sampler := rand.New(rand.NewSource(*sampleSeedFlag))
+	var discovered int64
+
+	// walkTree submits every PNG under root, or every file matching pattern relative to root.
+	// Outputs mirror where each file is below base.
+	walkTree := func(root, pattern, base string) error {
+		// stops the walk when we stop taking files from it
+		walkCtx, stop := context.WithCancel(ctx)
+		defer stop()
+
+		found, err := Discover(walkCtx, root, DiscoverOptions{
+			Pattern:        pattern,
+			ByContent:      *byContentFlag,
+			Recursive:      *recursiveFlag,
+			FollowSymlinks: *followSymlinksFlag,
+			OnError: func(path string, err error) {
+				errorf("skipping %s: %v", path, err)
+				atomic.AddInt64(&count.walkErrors, 1)
+			},
+		})
+		if err != nil {
+			errorf("skipping %s: %v", root, err)
+			atomic.AddInt64(&count.walkErrors, 1)
+			return nil
+		}
+
+		for path := range found {
+			discovered++
+			if *sampleFlag < 1 && sampler.Float64() >= *sampleFlag {
+				continue
+			}
 
-				p := *outputDirectory + path[strings.LastIndex(path, string(os.PathSeparator)):]
+			rel, err := filepath.Rel(base, path)
+			if err != nil {
+				rel = filepath.Base(path)
+			}
 
-				return strip(png, p, *webpFlag, *checkFlag)
+			if err := submit(path, rel); err != nil {
+				return err
 			}
 		}
+		return nil
+	}
 
-		return err
-	})
+	// the workers pick up files while the walk is still going, so processing starts with it too
+	walkStart := time.Now()
 
-	close(tasks)
+	if args := flag.Args(); len(args) > 0 {
+		// files named on the command line are processed as given, whatever their extension,
+		// and directories are walked like -input
+		for _, path := range args {
+			info, err := os.Stat(path)
+			if err != nil {
+				errorf("skipping %s: %v", path, err)
+				atomic.AddInt64(&count.total, 1)
+				atomic.AddInt64(&count.failed, 1)
+				continue
+			}
 
-	end := time.Now()
+			// files go to the top of -output, the second of two with the same name fails its claim
+			if info.IsDir() {
+				err = walkTree(path, "", path)
+			} else {
+				err = submit(path, filepath.Base(path))
+			}
 
-	log.Println("collected tasks, took", end.Sub(start).Seconds(), "seconds")
+			if err != nil {
+				break
+			}
+		}
+	} else {
+		// with -glob only the part of the tree the pattern can reach is walked
+		root, pattern, base := *inputDirectory, "", *inputDirectory
+		if *globFlag != "" {
+			if filepath.IsAbs(*globFlag) {
+				root = ""
+			} else if !isFlagSet("input") {
+				root = "."
+			}
 
-	for i := 0; i < *routinesFlag; i++ {
-		waitGroup.Add(1)
-		fmt.Printf("starting work group %d\n", i)
-		taskID := i
-		go func() {
+			prefix, rest := globBase(filepath.ToSlash(*globFlag))
+			root, pattern = filepath.Join(root, filepath.FromSlash(prefix)), rest
 
-			for f := range tasks {
-				e := f()
+			// an absolute pattern has nothing to be relative to but the part without wildcards
+			if filepath.IsAbs(*globFlag) {
+				base = root
+			} else if !isFlagSet("input") {
+				base = "."
+			}
 
-				if e != nil {
-					log.Println(e)
-				}
+			// nor does one climbing out of base, the outputs would land outside -output
+			if rel, err := filepath.Rel(base, root); err != nil || climbs(rel) {
+				base = root
 			}
+		}
 
-			fmt.Printf("worker group %d completed\n", taskID)
-			waitGroup.Done()
-		}()
+		walkTree(root, pattern, base)
+	}
+
+	if *maxFilesFlag > 0 && atomic.LoadInt64(&count.total) >= *maxFilesFlag {
+		logf("stopped looking for files after the first %d", *maxFilesFlag)
 	}
 
-	start = time.Now()
+	close(jobs)
+	walkTime := time.Since(walkStart)
+	logf("collected %d tasks in %v seconds, %v of them spent walking and %v waiting for a free worker",
+		atomic.LoadInt64(&count.total), walkTime.Seconds(), (walkTime - queueTime).Seconds(), queueTime.Seconds())
 
 	waitGroup.Wait()
-	end = time.Now()
-	fmt.Println("completed in", end.Sub(start).Seconds(), "seconds")
+	close(stopProgress)
+	// the workers started with the walk, so this covers both
+	totalTime := time.Since(walkStart)
+	logf("the workers finished %v seconds after the walk", (totalTime - walkTime).Seconds())
+	printf("completed in %v seconds\n", totalTime.Seconds())
+
+	if *pruneEmptyOutputDirsFlag {
+		n, err := outputDirs.prune()
+		if err != nil {
+			errorf("pruning empty output directories: %v", err)
+			atomic.AddInt64(&count.failed, 1)
+		}
+		logf("removed %d empty output directories", n)
+	}
+
+	if results != nil {
+		close(results)
+		if err := <-reportWritten; err != nil {
+			errorf("writing results: %v", err)
+			atomic.AddInt64(&count.failed, 1)
+		}
+	}
+
+	if opts.dryRun {
+		printf("dry run, stripping would process %s\n", totals.String())
+	} else {
+		printf("processed %s\n", totals.String())
+	}
+
+	throughput := totals.metrics(totalTime)
+	throughput.Failed = atomic.LoadInt64(&count.failed) + atomic.LoadInt64(&count.walkErrors)
+	printf("throughput: %.1f files/s, %s/s\n", throughput.FilesPerSecond, formatBytes(int64(throughput.BytesPerSecond)))
+
+	if *metricsFlag != "" {
+		if err := writeJSON(*metricsFlag, throughput); err != nil {
+			errorf("writing metrics: %v", err)
+			atomic.AddInt64(&count.failed, 1)
+		}
+	}
+
+	if n := atomic.LoadInt64(&linkedDuplicates); n > 0 {
+		printf("%d duplicate outputs were linked to an identical one\n", n)
+	}
+
+	if *statsPerChunkTypeFlag {
+		printf("removed by chunk type:\n")
+		for _, total := range removedByType.sorted() {
+			printf("  %s: %d chunks, %s\n", total.chunkType, total.chunks, formatBytes(total.bytes))
+		}
+	}
+
+	if *sampleFlag < 1 {
+		printf("sampled %d of the %d files found\n", atomic.LoadInt64(&count.total), discovered)
+	}
+
+	if opts.onlyBroken {
+		printf("%d broken files found\n", atomic.LoadInt64(&brokenFiles))
+	}
+
+	if n := atomic.LoadInt64(&belowMinSize); n > 0 && opts.dryRun {
+		printf("%d files under -min-size would be copied as is\n", n)
+	} else if n > 0 {
+		printf("%d files under -min-size were copied as is\n", n)
+	}
+
+	// let CI notice partial failures and interrupted runs
+	if count.failed > 0 {
+		errorf("%d of %d files failed", count.failed, count.total)
+	}
+	if count.walkErrors > 0 {
+		errorf("%d paths couldn't be read while looking for files", count.walkErrors)
+	}
+	if count.failed > 0 || count.walkErrors > 0 || ctx.Err() != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testOptions are the options of a plain run writing below a fresh temporary directory
+func testOptions(t testing.TB) *options {
+	return &options{
+		output:       t.TempDir(),
+		template:     "{dir}/{name}{ext}",
+		stripOptions: defaultStripOptions(),
+		claimed:      &claimSet{inputs: map[string]string{}},
+	}
+}
+
+// writeFile writes data to path, creating the directories it's in
+func writeFile(t testing.TB, path string, data []byte) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStripCreatesOutputDirectories(t *testing.T) {
+	o := testOptions(t)
+	output := filepath.Join(o.output, "a", "b", "c", "image.png")
+
+	written, _, err := o.strip(context.Background(), mustRead(t, encode(t, palettePNG(t)...)), output, false, o.stripOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != output {
+		t.Errorf("wrote %s, want %s", written, output)
+	}
+
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustRead(t, data)
+}
+
+// run processes every PNG Discover finds under root the way main does, returning the results
+// by input path along with the counters and everything logged
+func run(t *testing.T, o *options, root string) (map[string]*result, counters, string) {
+	t.Helper()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var count counters
+	found, err := Discover(context.Background(), root, DiscoverOptions{
+		Recursive: true,
+		OnError: func(path string, err error) {
+			errorf("skipping %s: %v", path, err)
+			atomic.AddInt64(&count.walkErrors, 1)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan job)
+	results := make(chan *result)
+	go func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		o.worker(ctx, cancel, jobs, results, &count)
+		close(results)
+	}()
+
+	go func() {
+		for path := range found {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				t.Error(err)
+			}
+			atomic.AddInt64(&count.total, 1)
+			jobs <- job{path: path, rel: rel}
+		}
+		close(jobs)
+	}()
+
+	byInput := map[string]*result{}
+	for res := range results {
+		byInput[res.Input] = res
+	}
+	return byInput, count, logged.String()
+}
+
+func TestRunSkipsUnreadableFiles(t *testing.T) {
+	root := t.TempDir()
+	good := filepath.Join(root, "good.png")
+	writeFile(t, good, encode(t, palettePNG(t)...))
+
+	// a file deleted after the walk found it, which is what a link to nothing looks like to the walk
+	missing := filepath.Join(root, "sub", "missing.png")
+	if err := os.MkdirAll(filepath.Dir(missing), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "gone.png"), missing); err != nil {
+		t.Fatal(err)
+	}
+
+	o := testOptions(t)
+	results, count, logged := run(t, o, root)
+
+	if count.done != 2 || count.failed != 1 {
+		t.Errorf("%d files done and %d failed, want 2 and 1", count.done, count.failed)
+	}
+	if res := results[good]; res == nil || res.Status != statusOK {
+		t.Errorf("good.png: %+v, want it stripped", res)
+	}
+	if res := results[missing]; res == nil || res.Status != statusError {
+		t.Errorf("missing.png: %+v, want it failed", res)
+	}
+	if !strings.Contains(logged, "skipping "+missing) {
+		t.Errorf("the skip of %s wasn't logged:\n%s", missing, logged)
+	}
+
+	if _, err := os.Stat(filepath.Join(o.output, "good.png")); err != nil {
+		t.Error(err)
+	}
+}
+
+// BenchmarkCopyable compares copying an input with nothing to strip against rebuilding it
+// chunk by chunk, both after the read process does before picking one
+func BenchmarkCopyable(b *testing.B) {
+	o := testOptions(b)
+	input := filepath.Join(b.TempDir(), "minimal.png")
+	writeFile(b, input, encode(b, gradientPNG(b)...))
+	output := filepath.Join(o.output, "minimal.png")
+
+	bench := func(b *testing.B, write func(f *os.File, png *PNG) error) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f, err := os.Open(input)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			png, err := o.prepare(f, input)
+			if err == nil {
+				err = write(f, png)
+			}
+			f.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("copy", func(b *testing.B) {
+		bench(b, func(f *os.File, png *PNG) error {
+			if !o.copyable(png, false) {
+				b.Fatal("the input isn't copyable")
+			}
+			_, _, err := o.copyInput(f, output)
+			return err
+		})
+	})
+
+	b.Run("strip", func(b *testing.B) {
+		bench(b, func(f *os.File, png *PNG) error {
+			_, _, err := o.strip(context.Background(), png, output, false, o.stripOptions)
+			return err
+		})
+	})
+}
+
+func TestCheckIgnoresUpToDateOutputs(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "image.png")
+	data := encode(t, palettePNG(t)...)
+	writeFile(t, input, data)
+
+	o := testOptions(t)
+	if err := o.process(context.Background(), job{path: input, rel: "image.png"}, &result{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// damage the first IDAT and make the input look older than its output
+	data[bytes.Index(data, []byte("IDAT"))+4] ^= 0xff
+	writeFile(t, input, data)
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(input, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	res := &result{}
+	if err := o.process(context.Background(), job{path: input, rel: "image.png"}, res); err != nil || res.Status != statusSkipped {
+		t.Fatalf("without -check: %v, status %q, want the up to date output to be skipped", err, res.Status)
+	}
+
+	for name, set := range map[string]func(*options){
+		"check":         func(o *options) { o.check = true },
+		"verify-output": func(o *options) { o.verifyOutput = true },
+	} {
+		checking := *o
+		set(&checking)
+		res := &result{}
+		if err := checking.process(context.Background(), job{path: input, rel: "image.png"}, res); !errors.Is(err, ErrorCRCMismatch) {
+			t.Errorf("-%s: got %v, status %q, want a crc mismatch", name, err, res.Status)
+		}
+	}
+}
+
+func TestOutputsMirrorTheInputTree(t *testing.T) {
+	root := t.TempDir()
+	a, b := filepath.Join(root, "a", "icon.png"), filepath.Join(root, "b", "c", "icon.png")
+	writeFile(t, a, encode(t, palettePNG(t)...))
+	writeFile(t, b, encode(t, gradientPNG(t)...))
+
+	o := testOptions(t)
+	if _, count, logged := run(t, o, root); count.failed > 0 {
+		t.Fatalf("%d files failed:\n%s", count.failed, logged)
+	}
+
+	// told apart by their widths
+	for output, want := range map[string]uint32{"a/icon.png": 4, "b/c/icon.png": 256} {
+		data, err := ioutil.ReadFile(filepath.Join(o.output, filepath.FromSlash(output)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if width, _, _, _, _, _, _, err := mustRead(t, data).IHDR(); err != nil || width != want {
+			t.Errorf("%s is %d pixels wide, want %d: %v", output, width, want, err)
+		}
+	}
+}
+
+func TestOutputsStayBelowTheOutputDirectory(t *testing.T) {
+	root := t.TempDir()
+	input := filepath.Join(root, "sib", "x.png")
+	data := encode(t, palettePNG(t)...)
+	writeFile(t, input, data)
+
+	o := testOptions(t)
+	o.force = true
+	if err := o.process(context.Background(), job{path: input, rel: filepath.Join("..", "sib", "x.png")}, &result{}); err == nil {
+		t.Error("processed a file whose output would be outside the output directory")
+	}
+
+	// the output directory is the input directory
+	o.output = root
+	if err := o.process(context.Background(), job{path: input, rel: filepath.Join("sib", "x.png")}, &result{}); err == nil {
+		t.Error("processed a file into itself")
+	}
+
+	if got, err := ioutil.ReadFile(input); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("the input changed: %v", err)
+	}
+}
+
+func TestGzippedCopyDoesNotClobberPlainPNG(t *testing.T) {
+	root := t.TempDir()
+	plain, gzipped := filepath.Join(root, "a.png"), filepath.Join(root, "a.png.gz")
+	writeFile(t, plain, encode(t, palettePNG(t)...))
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write(encode(t, gradientPNG(t)...))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, gzipped, compressed.Bytes())
+
+	o := testOptions(t)
+	results, count, _ := run(t, o, root)
+	if res := results[gzipped]; count.failed != 1 || res == nil || res.Status != statusError {
+		t.Errorf("%d files failed and a.png.gz got %+v, want only a.png.gz failing", count.failed, res)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(o.output, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width, _, _, _, _, _, _, _ := mustRead(t, data).IHDR(); width != 4 {
+		t.Errorf("the output is %d pixels wide, want it to come from a.png", width)
+	}
+	// a.png only clashes when the run processes it too
+	o = testOptions(t)
+	if err := o.process(context.Background(), job{path: gzipped, rel: "a.png.gz"}, &result{}); err != nil {
+		t.Errorf("a.png.gz on its own: %v", err)
+	}
+}
+
+func TestLenientRejectsDamagedCriticalChunks(t *testing.T) {
+	o := testOptions(t)
+	o.lenient = true
+
+	chunks := palettePNG(t)
+	chunks[6].CRC ^= 1
+	png, err := o.readInput(bytes.NewReader(encode(t, chunks...)), "damaged-tIME.png")
+	if err != nil {
+		t.Fatalf("a damaged tIME: %v", err)
+	}
+	if _, size, err := o.strip(context.Background(), png, filepath.Join(o.output, "tIME.png"), false, o.stripOptions); err != nil || size == 0 {
+		t.Fatalf("stripping a damaged tIME: %v", err)
+	}
+
+	for _, i := range []int{1, 4} {
+		chunks := palettePNG(t)
+		chunks[i].Data = append([]byte{}, chunks[i].Data...)
+		chunks[i].Data[0] ^= 0xff
+		if _, err := o.readInput(bytes.NewReader(encode(t, chunks...)), "damaged.png"); !errors.Is(err, ErrorCRCMismatch) {
+			t.Errorf("a damaged %s: got %v, want %v", chunks[i].Type, err, ErrorCRCMismatch)
+		}
+	}
+}
+
+func TestLenientAddsIENDOnlyToWholeImages(t *testing.T) {
+	o := testOptions(t)
+	o.lenient = true
+
+	chunks := palettePNG(t)
+	data := encode(t, chunks...)
+	offsets := chunkOffsets(chunks)
+
+	tests := []struct {
+		name  string
+		end   int64
+		whole bool
+	}{
+		{"after IHDR", offsets[1], false},
+		{"between IDATs", offsets[4], false},
+		{"inside the last IDAT", offsets[5] + 10, false},
+		{"after the last IDAT", offsets[6], true},
+		{"inside tIME", offsets[6] + 10, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			png, err := o.readInput(bytes.NewReader(data[:test.end]), "cut.png")
+			if !test.whole {
+				if err == nil {
+					t.Fatalf("recovered %v", chunkTypes(png))
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if types := chunkTypes(png); types[len(types)-1] != "IEND" || len(png.Chunks["IDAT"]) != 3 {
+				t.Errorf("recovered %v, want every IDAT followed by IEND", types)
+			}
+		})
+	}
+}
+
+func TestReadErrorsNameTheFile(t *testing.T) {
+	damaged := palettePNG(t)
+	damaged[6].CRC ^= 1
+
+	inputs := map[string][]byte{
+		"not-a.png": []byte("GIF89a\x01\x00\x01\x00"),
+		"crc.png":   encode(t, damaged...),
+	}
+
+	for name, set := range map[string]func(*options){
+		"default": func(*options) {},
+		"lenient": func(o *options) { o.lenient = true },
+		"check":   func(o *options) { o.check = true },
+	} {
+		for path, data := range inputs {
+			// -lenient recovers from the damaged tIME
+			if name == "lenient" && path == "crc.png" {
+				continue
+			}
+
+			o := testOptions(t)
+			set(o)
+			_, err := o.prepare(bytes.NewReader(data), path)
+			if err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+				t.Errorf("%s, %s: got %v, want an error naming the file", name, path, err)
+			}
+		}
+	}
+}
+
+func TestSharedOutputsFail(t *testing.T) {
+	root := t.TempDir()
+	a, b := filepath.Join(root, "a", "icon.png"), filepath.Join(root, "b", "icon.png")
+	writeFile(t, a, encode(t, palettePNG(t)...))
+	writeFile(t, b, encode(t, gradientPNG(t)...))
+
+	// every icon.png goes to the top of the output directory
+	o := testOptions(t)
+	o.template = "{name}{ext}"
+	results, count, _ := run(t, o, root)
+
+	if count.failed != 1 {
+		t.Fatalf("%d files failed, want the second icon.png to", count.failed)
+	}
+	if res := results[b]; res == nil || !strings.Contains(res.Error, a) || !strings.Contains(res.Error, b) {
+		t.Errorf("b/icon.png: %+v, want an error naming both inputs", res)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(o.output, "icon.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width, _, _, _, _, _, _, _ := mustRead(t, data).IHDR(); width != 4 {
+		t.Errorf("the output is %d pixels wide, want it to come from a/icon.png", width)
+	}
+}
+
+func TestSameNamedArgumentsFail(t *testing.T) {
+	root := t.TempDir()
+	a, b := filepath.Join(root, "a", "x.png"), filepath.Join(root, "b", "x.png")
+	writeFile(t, a, encode(t, palettePNG(t)...))
+	writeFile(t, b, encode(t, gradientPNG(t)...))
+
+	// the way main submits files named on the command line
+	o := testOptions(t)
+	if err := o.process(context.Background(), job{path: a, rel: filepath.Base(a)}, &result{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.process(context.Background(), job{path: b, rel: filepath.Base(b)}, &result{}); err == nil || !strings.Contains(err.Error(), a) {
+		t.Errorf("processing b/x.png after a/x.png: got %v, want an error naming a/x.png", err)
+	}
+	// naming the same file twice isn't a clash
+	if err := o.process(context.Background(), job{path: a, rel: filepath.Base(a)}, &result{}); err != nil {
+		t.Errorf("processing a/x.png again: %v", err)
+	}
+}
+
+func TestDedupVerifiesLinkedOutputs(t *testing.T) {
+	// the index is shared by the whole run, start from an empty one
+	outputHashes = hashIndex{entries: map[[sha256.Size]byte]*hashEntry{}}
+
+	root := t.TempDir()
+	a, b := filepath.Join(root, "a.png"), filepath.Join(root, "b.png")
+	data := encode(t, palettePNG(t)...)
+	writeFile(t, a, data)
+	writeFile(t, b, data)
+
+	o := testOptions(t)
+	o.dedup, o.verifyOutput = true, true
+	if err := o.process(context.Background(), job{path: a, rel: "a.png"}, &result{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// damage the first output without replacing the file, the link shares whatever is in it
+	first := filepath.Join(o.output, "a.png")
+	if err := ioutil.WriteFile(first, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.process(context.Background(), job{path: b, rel: "b.png"}, &result{}); err == nil {
+		t.Error("linked b.png to an output that doesn't decode")
+	}
+	if _, err := os.Stat(filepath.Join(o.output, "b.png")); !os.IsNotExist(err) {
+		t.Errorf("the bad link to b.png was left behind: %v", err)
+	}
+}
+
+func TestStampReadsWithMaxChunk(t *testing.T) {
+	o := testOptions(t)
+	o.stampKeyword, o.stampText = "Software", "png-stripper"
+
+	buf := bytes.NewBuffer(encode(t, palettePNG(t)...))
+	if err := o.stamp(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the IHDR is 13 bytes
+	o.maxChunk = 8
+	if err := o.stamp(buf); !errors.Is(err, ErrorChunkTooLarge) {
+		t.Errorf("stamping with -max-chunk 8: got %v, want %v", err, ErrorChunkTooLarge)
+	}
+}
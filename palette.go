@@ -0,0 +1,136 @@
+package main
+
+import "errors"
+
+var ErrorInvalidPalette = errors.New("invalid palette")
+
+//TrimPalette shrinks the PLTE of an indexed image down to the entries its pixels actually use,
+//remapping the image data, tRNS, bKGD and hIST to match. Images that aren't indexed are left alone.
+//The image data is rewritten as a single IDAT, keeping its interlacing. Animated PNGs return
+//ErrorAnimated, their frames would keep pointing at the old palette.
+func (p *PNG) TrimPalette() error {
+	_, _, _, colorType, _, _, _, err := p.IHDR()
+	if err != nil {
+		return err
+	}
+
+	if colorType != 3 {
+		return nil
+	}
+
+	if len(p.Chunks["PLTE"]) == 0 {
+		return ErrorMissingChunk
+	}
+
+	if p.animated() {
+		return ErrorAnimated
+	}
+
+	plte := p.Chunks["PLTE"][0]
+	if len(plte.Data)%3 != 0 || len(plte.Data) == 0 {
+		return ErrorInvalidPalette
+	}
+	entries := len(plte.Data) / 3
+
+	img, err := p.decodeImageData()
+	if err != nil {
+		return err
+	}
+
+	used := make([]bool, 256)
+	for _, pass := range img.passes {
+		for _, row := range pass.rows {
+			for x := 0; x < int(pass.width); x++ {
+				used[sample(row, x, img.bitDepth)] = true
+			}
+		}
+	}
+
+	// the background colour points into the palette too
+	var bkgd *Chunk
+	if chunks := p.Chunks["bKGD"]; len(chunks) > 0 && len(chunks[0].Data) == 1 {
+		bkgd = chunks[0]
+		used[bkgd.Data[0]] = true
+	}
+
+	// old index -> new index, keeping the palette's order
+	remap := make([]byte, 256)
+	var kept []int
+	for i := 0; i < entries; i++ {
+		if used[i] {
+			remap[i] = byte(len(kept))
+			kept = append(kept, i)
+		}
+	}
+
+	for i := entries; i < len(used); i++ {
+		if used[i] {
+			return ErrorInvalidPalette
+		}
+	}
+
+	if len(kept) == entries {
+		// every entry is in use, nothing to trim
+		return nil
+	}
+
+	palette := make([]byte, 0, len(kept)*3)
+	for _, i := range kept {
+		palette = append(palette, plte.Data[i*3:i*3+3]...)
+	}
+	plte.Data = palette
+	plte.UpdateCRC()
+
+	if chunks := p.Chunks["tRNS"]; len(chunks) > 0 {
+		trns := chunks[0]
+		alpha := make([]byte, len(kept))
+		for n, i := range kept {
+			alpha[n] = 255
+			if i < len(trns.Data) {
+				alpha[n] = trns.Data[i]
+			}
+		}
+
+		// trailing entries are opaque by default
+		for len(alpha) > 0 && alpha[len(alpha)-1] == 255 {
+			alpha = alpha[:len(alpha)-1]
+		}
+
+		if len(alpha) == 0 {
+			p.removeChunks("tRNS")
+		} else {
+			trns.Data = alpha
+			trns.UpdateCRC()
+		}
+	}
+
+	if chunks := p.Chunks["hIST"]; len(chunks) > 0 && len(chunks[0].Data) == entries*2 {
+		hist := chunks[0]
+		frequencies := make([]byte, 0, len(kept)*2)
+		for _, i := range kept {
+			frequencies = append(frequencies, hist.Data[i*2:i*2+2]...)
+		}
+		hist.Data = frequencies
+		hist.UpdateCRC()
+	}
+
+	if bkgd != nil {
+		bkgd.Data[0] = remap[bkgd.Data[0]]
+		bkgd.UpdateCRC()
+	}
+
+	for _, pass := range img.passes {
+		for _, row := range pass.rows {
+			for x := 0; x < int(pass.width); x++ {
+				setSample(row, x, img.bitDepth, remap[sample(row, x, img.bitDepth)])
+			}
+		}
+	}
+
+	data, err := img.encode()
+	if err != nil {
+		return err
+	}
+	p.replaceImageData(data)
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// animate turns chunks into a two frame APNG, the second frame an fdAT copy of the image data
+func animate(t *testing.T, chunks []*Chunk) []*Chunk {
+	var frame []byte
+	for _, chunk := range chunks {
+		if chunk.Type == "IDAT" {
+			frame = append(frame, chunk.Data...)
+		}
+	}
+
+	actl := newChunk("acTL", []byte{0, 0, 0, 2, 0, 0, 0, 0})
+	fdat := newChunk("fdAT", append([]byte{0, 0, 0, 2}, frame...))
+	animated := append([]*Chunk{chunks[0], actl}, chunks[1:len(chunks)-1]...)
+	return append(animated, fdat, chunks[len(chunks)-1])
+}
+
+func TestTrimPalette(t *testing.T) {
+	chunks := palettePNG(t)
+	// a fourth colour nothing uses
+	chunks[1] = newChunk("PLTE", append(append([]byte{}, chunks[1].Data...), 9, 9, 9))
+
+	png := mustRead(t, encode(t, chunks...))
+	if err := png.TrimPalette(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(png.Chunks["PLTE"][0].Data) / 3; n != 3 {
+		t.Errorf("%d palette entries after trimming, want 3", n)
+	}
+
+	png = mustRead(t, encode(t, animate(t, chunks)...))
+	if err := png.TrimPalette(); err != ErrorAnimated {
+		t.Fatalf("trimming an APNG: got %v, want %v", err, ErrorAnimated)
+	}
+	if !bytes.Equal(png.Chunks["PLTE"][0].Data, chunks[1].Data) {
+		t.Errorf("the palette of the APNG changed")
+	}
+}
@@ -8,8 +8,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
 )
 
 var (
@@ -22,10 +27,83 @@ var (
 	ErrorUnixToDOSConversion = errors.New("unix to dos conversion")
 
 	ErrorNoMissingBytes = errors.New("no missing bytes")
+
+	ErrorChunkTooLarge = errors.New("chunk length exceeds the maximum")
+	ErrorBadChunkType  = errors.New("chunk type isn't four ASCII letters")
+
+	ErrorMissingIHDR = errors.New("missing IHDR chunk")
+	ErrorInvalidIHDR = errors.New("invalid IHDR length")
+	ErrorMissingIEND = errors.New("missing IEND chunk")
 )
 
+//MissingBytesError reports how far a chunk's data falls short of (or runs past) its declared length.
+//It matches ErrorMissingBytes with errors.Is.
+type MissingBytesError struct {
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *MissingBytesError) Error() string {
+	return fmt.Sprintf("%v: expected %d bytes, got %d", ErrorMissingBytes, e.Expected, e.Actual)
+}
+
+func (e *MissingBytesError) Is(target error) bool {
+	return target == ErrorMissingBytes
+}
+
+//ChunkError says which chunk a read failed on and where it starts in the file
+type ChunkError struct {
+	// Type is empty when the stream ended before the type could be read
+	Type   string
+	Index  int
+	Offset int64
+	Err    error
+}
+
+func (e *ChunkError) Error() string {
+	chunkType := e.Type
+	if chunkType == "" {
+		chunkType = "unknown"
+	} else {
+		chunkType = printableType(chunkType)
+	}
+	return fmt.Sprintf("%s chunk %d at offset %d: %v", chunkType, e.Index, e.Offset, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+//ChecksumError reports a chunk that failed verification while being written out
+type ChecksumError struct {
+	// Path is the file the chunk came from, left empty by Strip for the caller to fill in
+	Path      string
+	ChunkType string
+	// Err is ErrorCRCMismatch or a MissingBytesError
+	Err error
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s chunk failed checksum: %v", e.ChunkType, e.Err)
+	}
+	return fmt.Sprintf("%s: %s chunk failed checksum: %v", e.Path, e.ChunkType, e.Err)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return e.Err
+}
+
 var PNGHeader = []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a}
 
+// chunkOverhead is the length, type and CRC around the data of every chunk, 4 bytes each
+const chunkOverhead = 12
+
+//DefaultMaxChunkLength is the largest chunk length Read accepts before allocating unless
+//ReadOptions.MaxChunkLength says otherwise, corrupt or malicious files can otherwise claim
+//gigabyte sized chunks
+const DefaultMaxChunkLength uint32 = 100 << 20
+
 //Chunk represents a chunk within the PNG file
 type Chunk struct {
 	Length uint32
@@ -34,11 +112,36 @@ type Chunk struct {
 	CRC    uint32
 }
 
-func (c *Chunk) Write(w io.Writer) {
-	binary.Write(w, binary.BigEndian, c.Length)
-	binary.Write(w, binary.BigEndian, []byte(c.Type))
-	binary.Write(w, binary.BigEndian, c.Data)
-	binary.Write(w, binary.BigEndian, c.CRC)
+// chunkPreview is how many bytes of data Chunk.String shows
+const chunkPreview = 16
+
+//String describes the chunk for logs and debugging, showing only the first bytes of its data
+func (c *Chunk) String() string {
+	preview := c.Data
+	more := ""
+	if len(preview) > chunkPreview {
+		preview, more = preview[:chunkPreview], "..."
+	}
+	return fmt.Sprintf("%s length=%d crc=%08x data=%x%s", printableType(c.Type), c.Length, c.CRC, preview, more)
+}
+
+// printableType quotes a chunk type that isn't four letters, keeping the control characters of a
+// desynchronised read out of the terminal
+func printableType(chunkType string) string {
+	if isValidChunkType(chunkType) {
+		return chunkType
+	}
+	return strconv.Quote(chunkType)
+}
+
+//Write writes the chunk to w in its on-disk layout, returning the first error encountered
+func (c *Chunk) Write(w io.Writer) error {
+	for _, v := range []interface{}{c.Length, []byte(c.Type), c.Data, c.CRC} {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return fmt.Errorf("writing %s chunk: %w", c.Type, err)
+		}
+	}
+	return nil
 }
 
 //Verify attempts to verify the chunk with the CRC & Length of the file
@@ -46,10 +149,10 @@ func (c *Chunk) Verify() (uint32, error) {
 
 	if int(c.Length) != len(c.Data) {
 		// woop. missing bytes
-		return 0, ErrorMissingBytes
+		return 0, c.missingBytes()
 	}
 
-	dataCrc := crc32.ChecksumIEEE(bytes.Join([][]byte{[]byte(c.Type), c.Data}, []byte{}))
+	dataCrc := c.checksum()
 	if dataCrc != c.CRC {
 		return dataCrc, ErrorCRCMismatch
 	}
@@ -57,92 +160,679 @@ func (c *Chunk) Verify() (uint32, error) {
 	return 0, nil
 }
 
+//UpdateCRC refreshes Length and CRC from the chunk's current Data, call it after modifying Data
+func (c *Chunk) UpdateCRC() {
+	c.Length = uint32(len(c.Data))
+	c.CRC = c.checksum()
+}
+
+//RepairCRC replaces the stored CRC with the checksum of the chunk's data. A chunk whose data
+//doesn't match its Length was truncated, that can't be repaired and returns a MissingBytesError.
+func (c *Chunk) RepairCRC() error {
+	if int(c.Length) != len(c.Data) {
+		return c.missingBytes()
+	}
+	c.CRC = c.checksum()
+	return nil
+}
+
+//Equal reports whether both chunks have the same type, length, data and CRC
+func (c *Chunk) Equal(other *Chunk) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+	return c.Type == other.Type && c.Length == other.Length && c.CRC == other.CRC && bytes.Equal(c.Data, other.Data)
+}
+
+//IsCritical reports whether the chunk is needed to display the image, an uppercase first letter
+func (c *Chunk) IsCritical() bool {
+	return len(c.Type) == 4 && c.Type[0]&0x20 == 0
+}
+
+//IsPublic reports whether the chunk type is defined by the spec rather than privately, an uppercase second letter
+func (c *Chunk) IsPublic() bool {
+	return len(c.Type) == 4 && c.Type[1]&0x20 == 0
+}
+
+//IsSafeToCopy reports whether an editor that doesn't understand the chunk may still copy it
+//into a modified image, a lowercase last letter
+func (c *Chunk) IsSafeToCopy() bool {
+	return len(c.Type) == 4 && c.Type[3]&0x20 != 0
+}
+
+// isValidChunkType reports whether chunkType is four ASCII letters, anything else means the
+// reader lost its place in the stream, usually after a corrupt length
+func isValidChunkType(chunkType string) bool {
+	if len(chunkType) != 4 {
+		return false
+	}
+
+	for i := 0; i < len(chunkType); i++ {
+		if c := chunkType[i] | 0x20; c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// reservedBitSet reports whether the third letter is lowercase, no valid chunk type has that
+func (c *Chunk) reservedBitSet() bool {
+	return len(c.Type) == 4 && c.Type[2]&0x20 != 0
+}
+
+// missingBytes describes the gap between the chunk's Length and its Data
+func (c *Chunk) missingBytes() error {
+	return &MissingBytesError{Expected: c.Length, Actual: uint32(len(c.Data))}
+}
+
+// checksum computes the CRC over the chunk type and data
+func (c *Chunk) checksum() uint32 {
+	return crc32.Update(crc32.ChecksumIEEE([]byte(c.Type)), crc32.IEEETable, c.Data)
+}
+
 type Header struct {
 	HeaderBytes []byte
 }
 
+//Verify checks the header against the PNG signature, recognising the damage done by
+//line ending conversions so the caller can tell a mangled PNG from something else entirely
 func (h *Header) Verify() error {
-	if h.HeaderBytes[0] != 0x89 && string(h.HeaderBytes[1:4]) != "PNG" {
+	b := h.HeaderBytes
+
+	// the high bit byte and "PNG" survive line ending conversions
+	n := len(b)
+	if n > 4 {
+		n = 4
+	}
+	if !bytes.Equal(b[:n], PNGHeader[:n]) {
 		return ErrorNotPNG
 	}
 
-	if len(h.HeaderBytes) < 8 {
-		if h.HeaderBytes[5] != 0x0D {
-			return ErrorDOSToUnixConversion
-		}
-		return ErrorInvalidHeaderLength
+	if bytes.Equal(b, PNGHeader) {
+		return nil
 	}
 
-	if h.HeaderBytes[7] != 0x0A {
+	// CRLF at bytes 4 and 5 collapsed to a lone LF, pulling the 0x1A up to byte 5
+	if len(b) > 5 && b[4] == 0x0A && b[5] == 0x1A {
+		return ErrorDOSToUnixConversion
+	}
+
+	// the LF at byte 5 grew a CR in front of it, pushing 0x1A down to byte 7
+	if len(b) > 7 && b[5] == 0x0D && b[7] == 0x1A {
 		return ErrorUnixToDOSConversion
 	}
-	return nil
+
+	if len(b) < len(PNGHeader) {
+		return ErrorInvalidHeaderLength
+	}
+	return ErrorNotPNG
+}
+
+// the signature as it looks after a DOS to Unix (CRLF to LF) or Unix to DOS (LF to CRLF) conversion
+var (
+	dosToUnixHeader = []byte{0x89, 0x50, 0x4e, 0x47, 0x0a, 0x1a, 0x0a}
+	unixToDOSHeader = []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0d, 0x0a, 0x1a, 0x0d, 0x0a}
+)
+
+//RepairHeader takes the leading bytes of a file and, if its signature was mangled by a line ending
+//conversion, returns them with the canonical PNGHeader restored. Only the signature is repaired,
+//any line endings converted inside chunk data will still show up as CRC mismatches.
+func RepairHeader(b []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(b, PNGHeader):
+		return b, nil
+	case bytes.HasPrefix(b, unixToDOSHeader):
+		return append(append([]byte{}, PNGHeader...), b[len(unixToDOSHeader):]...), nil
+	case bytes.HasPrefix(b, dosToUnixHeader):
+		return append(append([]byte{}, PNGHeader...), b[len(dosToUnixHeader):]...), nil
+	}
+
+	if len(b) > len(PNGHeader) {
+		b = b[:len(PNGHeader)]
+	}
+	if err := (&Header{b}).Verify(); err != nil {
+		return nil, err
+	}
+	return nil, ErrorNotPNG
 }
 
 //PNG represents the PNG file structure
 type PNG struct {
 	FileHeader *Header
 	Chunks     map[string][]*Chunk
+	// Order holds every chunk in the order it appeared in the file, as filled in by Read,
+	// ReadLenient and Parse. When it's empty the chunks are written in a canonical order
+	// instead. It holds the same chunks as Chunks, anything editing one has to edit both.
+	Order []*Chunk
+	// TrailingBytes counts the bytes found after IEND when ReadOptions.CountTrailing is set,
+	// anything there was appended to the image and is never written back out
+	TrailingBytes int64
+	// MissingIEND is set by ReadLenient when the input ended before its IEND chunk
+	MissingIEND bool
 }
 
-func Read(reader io.Reader) (*PNG, error) {
-	buf := bufio.NewReader(reader)
+//IHDR parses the image header chunk
+func (p *PNG) IHDR() (width, height uint32, bitDepth, colorType, compression, filter, interlace uint8, err error) {
+	if len(p.Chunks["IHDR"]) == 0 {
+		err = ErrorMissingIHDR
+		return
+	}
 
-	magicHeader := make([]byte, 8)
-	buf.Read(magicHeader)
+	data := p.Chunks["IHDR"][0].Data
+	if len(data) != 13 {
+		err = ErrorInvalidIHDR
+		return
+	}
 
-	var chunks = map[string][]*Chunk{}
-	localBuffer := make([]byte, 4)
+	width = binary.BigEndian.Uint32(data[0:4])
+	height = binary.BigEndian.Uint32(data[4:8])
+	bitDepth, colorType = data[8], data[9]
+	compression, filter, interlace = data[10], data[11], data[12]
+	return
+}
 
-	for {
-		var length uint32
-		var chunkType string
-		var data []byte
-		var crc uint32
+//WriteTo writes the PNG signature followed by every chunk in file order, implementing io.WriterTo
+func (p *PNG) WriteTo(w io.Writer) (int64, error) {
+	// counts what a failed write got out too, not just the chunks written in full
+	counter := &countingWriter{w: w}
+	if _, err := counter.Write(PNGHeader); err != nil {
+		return counter.n, err
+	}
+
+	for _, chunk := range p.chunks() {
+		if err := chunk.Write(counter); err != nil {
+			return counter.n, err
+		}
+	}
+	return counter.n, nil
+}
+
+// countingWriter passes writes through to w, adding up the bytes w took
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+//EqualImage reports whether both PNGs hold the same image, comparing only the critical chunks so
+//differing metadata doesn't matter. IDAT chunks are compared as one stream since how the image
+//data is split between them is arbitrary.
+func (p *PNG) EqualImage(other *PNG) bool {
+	a, aData := p.criticalChunks()
+	b, bData := other.criticalChunks()
+
+	if len(a) != len(b) || !bytes.Equal(aData, bData) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//AncillaryBytes is the space taken up by ancillary chunks including their headers and CRCs,
+//the most stripping could save
+func (p *PNG) AncillaryBytes() int {
+	n := 0
+	for _, chunk := range p.chunks() {
+		if !chunk.IsCritical() {
+			n += chunkOverhead + len(chunk.Data)
+		}
+	}
+	return n
+}
+
+// criticalChunks returns the critical chunks other than IDAT in order, along with the image data
+func (p *PNG) criticalChunks() ([]*Chunk, []byte) {
+	var critical []*Chunk
+	var data []byte
+
+	for _, chunk := range p.chunks() {
+		switch {
+		case chunk.Type == "IDAT":
+			data = append(data, chunk.Data...)
+		case chunk.IsCritical():
+			critical = append(critical, chunk)
+		}
+	}
+	return critical, data
+}
+
+//AddIEND appends an IEND chunk, salvaging an image whose file was cut short after its last chunk
+func (p *PNG) AddIEND() {
+	iend := &Chunk{Type: "IEND"}
+	iend.UpdateCRC()
+
+	p.Chunks["IEND"] = append(p.Chunks["IEND"], iend)
+	if len(p.Order) > 0 {
+		p.Order = append(p.Order, iend)
+	}
+	p.MissingIEND = false
+}
+
+// chunks returns the chunks in the order they are written. That's Order for anything read from a
+// file, a PNG built up by hand with only Chunks filled in gets a canonical order instead of map
+// order so the same chunks always produce the same bytes.
+func (p *PNG) chunks() []*Chunk {
+	if len(p.Order) > 0 {
+		return p.Order
+	}
 
-		binary.Read(buf, binary.BigEndian, &length)
+	types := make([]string, 0, len(p.Chunks))
+	for chunkType := range p.Chunks {
+		types = append(types, chunkType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if a, b := canonicalRank(types[i]), canonicalRank(types[j]); a != b {
+			return a < b
+		}
+		return types[i] < types[j]
+	})
+
+	var order []*Chunk
+	for _, chunkType := range types {
+		order = append(order, p.Chunks[chunkType]...)
+	}
+	return order
+}
+
+// canonicalRank sorts chunk types into a position the spec allows them in
+func canonicalRank(chunkType string) int {
+	switch chunkType {
+	case "IHDR":
+		return 0
+	case "PLTE":
+		return 2
+	case "IDAT":
+		return 4
+	case "IEND":
+		return 6
+	}
+
+	rule, ok := placements[chunkType]
+	switch {
+	case !ok || !rule.beforeIDAT:
+		return 5
+	case rule.beforePLTE:
+		return 1
+	}
+	return 3
+}
+
+//ReadOptions changes how ReadWithOptions parses a PNG
+type ReadOptions struct {
+	// FixCRC repairs chunks whose stored CRC doesn't match their data instead of failing the read
+	FixCRC bool
+	// BufferSize sets the size of the read buffer wrapped around the input, bigger buffers help
+	// with very large files on fast disks. Zero uses bufio's default.
+	BufferSize int
+	// MaxChunkLength is the largest chunk length accepted, zero meaning DefaultMaxChunkLength
+	MaxChunkLength uint32
+	// CountTrailing reads on past IEND to the end of the input, setting PNG.TrailingBytes
+	CountTrailing bool
+}
+
+//Read parses a PNG from reader, failing on the first corrupt chunk
+func Read(reader io.Reader) (*PNG, error) {
+	return ReadWithOptions(reader, ReadOptions{})
+}
 
-		buf.Read(localBuffer)
-		chunkType = string(localBuffer)
+//ReadWithOptions parses a PNG from reader the way opts asks for
+func ReadWithOptions(reader io.Reader, opts ReadOptions) (*PNG, error) {
+	return readSized(reader, 0, opts)
+}
 
-		data = make([]byte, length)
+//Parse parses a PNG held in memory. Knowing where the data ends, a chunk whose length runs
+//past it fails with ErrorMissingBytes before anything is allocated for it.
+func Parse(b []byte) (*PNG, error) {
+	return readSized(bytes.NewReader(b), int64(len(b)), ReadOptions{})
+}
 
-		io.ReadFull(buf, data)
+// readSized does the work for ReadWithOptions and Parse, size is the length of the stream or 0 when unknown
+func readSized(reader io.Reader, size int64, opts ReadOptions) (*PNG, error) {
+	buf := getReader(reader, opts.BufferSize)
+	defer putReader(buf)
 
-		binary.Read(buf, binary.BigEndian, &crc)
+	png, err := readOne(buf, size, &opts)
+	if err != nil {
+		return nil, err
+	}
 
-		checkSumMe := []byte(chunkType)
+	if opts.CountTrailing {
+		if png.TrailingBytes, err = io.Copy(ioutil.Discard, buf); err != nil {
+			return nil, err
+		}
+	}
+	return png, nil
+}
 
-		checkSumMe = append(checkSumMe, data...)
+//ReadAll reads every PNG in a stream of them written back to back, as some capture tools do,
+//until the stream ends. Anything but another signature after an IEND fails with ErrorNotPNG,
+//returned along with the images read before it.
+func ReadAll(reader io.Reader) ([]*PNG, error) {
+	buf := getReader(reader, 0)
+	defer putReader(buf)
 
-		ourCrc := crc32.ChecksumIEEE(checkSumMe)
+	var pngs []*PNG
+	for {
+		// an empty stream still has to fail on its missing signature
+		if _, err := buf.Peek(1); err == io.EOF && len(pngs) > 0 {
+			return pngs, nil
+		}
 
-		if ourCrc != crc {
-			return nil, ErrorCRCMismatch
+		png, err := readOne(buf, 0, &ReadOptions{})
+		if err != nil {
+			return pngs, fmt.Errorf("image %d: %w", len(pngs), err)
 		}
+		pngs = append(pngs, png)
+	}
+}
+
+// readOne reads a single PNG from its signature up to IEND, leaving reader on the byte after it.
+// size is the length of the stream or 0 when unknown.
+func readOne(reader io.Reader, size int64, opts *ReadOptions) (*PNG, error) {
+	header, err := readHeader(reader)
+	if err != nil {
+		return nil, err
+	}
 
-		chunk := &Chunk{
-			Length: length,
-			Type:   chunkType,
-			Data:   data,
-			CRC:    crc,
+	var chunks = map[string][]*Chunk{}
+	var order []*Chunk
+	chunkReader := newChunkReader(reader, opts)
+	chunkReader.size = size
+
+	for {
+		chunk, err := chunkReader.next(nil)
+		if err != nil {
+			return nil, err
 		}
 
-		if _, ok := chunks[chunkType]; !ok {
-			chunks[chunkType] = make([]*Chunk, 0)
+		if _, ok := chunks[chunk.Type]; !ok {
+			chunks[chunk.Type] = make([]*Chunk, 0)
 		}
 
-		v := chunks[chunkType]
+		v := chunks[chunk.Type]
 		v = append(v, chunk)
-		chunks[chunkType] = v
+		chunks[chunk.Type] = v
+		order = append(order, chunk)
 
-		if chunkType == "IEND" {
+		if chunk.Type == "IEND" {
 			break
 		}
 	}
 
 	return &PNG{
-		FileHeader: &Header{magicHeader},
+		FileHeader: header,
 		Chunks:     chunks,
+		Order:      order,
 	}, nil
 }
+
+//ReadLenient parses as much of a PNG as it can. Chunks failing their CRC are kept and
+//reported rather than ending the read, and a read cut short by a truncated or corrupt
+//stream returns the chunks read so far with MissingIEND set. The PNG is nil only when the
+//signature is bad.
+func ReadLenient(reader io.Reader, opts ReadOptions) (*PNG, []error) {
+	buf := getReader(reader, opts.BufferSize)
+	defer putReader(buf)
+
+	header, err := readHeader(buf)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	png := &PNG{
+		FileHeader: header,
+		Chunks:     map[string][]*Chunk{},
+	}
+	var errs []error
+	chunkReader := newChunkReader(buf, &opts)
+
+	for {
+		chunk, err := chunkReader.next(nil)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		// anything other than a bad CRC leaves us out of step with the stream
+		if chunk == nil {
+			png.MissingIEND = true
+			return png, errs
+		}
+
+		png.Chunks[chunk.Type] = append(png.Chunks[chunk.Type], chunk)
+		png.Order = append(png.Order, chunk)
+
+		if chunk.Type == "IEND" {
+			if opts.CountTrailing {
+				if png.TrailingBytes, err = io.Copy(ioutil.Discard, buf); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			return png, errs
+		}
+	}
+}
+
+//ReadStreaming reads the PNG from reader chunk by chunk, calling visit with each chunk once its CRC is verified.
+//The chunk's Data is only valid until visit returns, its buffer is reused for the next chunk so memory
+//stays bounded by the largest chunk rather than the whole file. Returning an error from visit stops the read.
+func ReadStreaming(reader io.Reader, visit func(*Chunk) error) error {
+	buf := getReader(reader, 0)
+	defer putReader(buf)
+
+	if _, err := readHeader(buf); err != nil {
+		return err
+	}
+
+	chunkReader := newChunkReader(buf, &ReadOptions{})
+	data := getData()
+	defer func() { putData(data) }()
+
+	for {
+		chunk, err := chunkReader.next(data)
+		if err != nil {
+			return err
+		}
+		data = chunk.Data
+
+		if err = visit(chunk); err != nil {
+			return err
+		}
+
+		if chunk.Type == "IEND" {
+			return nil
+		}
+	}
+}
+
+// defaultBufferSize is bufio's own default, readers of that size are pooled
+const defaultBufferSize = 4096
+
+//Verify streams through the PNG in reader checking the signature and the CRC of every chunk,
+//returning the first failure. Nothing is kept, only one chunk is held in memory at a time.
+func Verify(reader io.Reader) error {
+	return ReadStreaming(reader, func(*Chunk) error { return nil })
+}
+
+// readerPool recycles the bufio.Readers wrapped around each input, going through thousands of
+// files otherwise allocates a fresh 4KB buffer for every one of them
+var readerPool = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, defaultBufferSize) }}
+
+// getReader wraps reader in a buffer of size bytes, zero meaning the default
+func getReader(reader io.Reader, size int) *bufio.Reader {
+	if size > 0 && size != defaultBufferSize {
+		return bufio.NewReaderSize(reader, size)
+	}
+
+	buf := readerPool.Get().(*bufio.Reader)
+	buf.Reset(reader)
+	return buf
+}
+
+func putReader(buf *bufio.Reader) {
+	// don't hold on to the input
+	buf.Reset(nil)
+	if buf.Size() == defaultBufferSize {
+		readerPool.Put(buf)
+	}
+}
+
+// maxPooledData is the largest chunk buffer handed back to dataPool, the odd huge chunk
+// shouldn't stay pinned in memory for the rest of the run
+const maxPooledData = 1 << 20
+
+// dataPool recycles the chunk data buffers of the reads that only look at one chunk at a time
+var dataPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+func getData() []byte {
+	return *dataPool.Get().(*[]byte)
+}
+
+func putData(data []byte) {
+	if cap(data) <= maxPooledData {
+		data = data[:0]
+		dataPool.Put(&data)
+	}
+}
+
+// readHeader reads and checks the PNG signature
+func readHeader(reader io.Reader) (*Header, error) {
+	magicHeader := make([]byte, len(PNGHeader))
+	n, err := io.ReadFull(reader, magicHeader)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	header := &Header{magicHeader[:n]}
+	if err = header.Verify(); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// chunkReader reads consecutive chunks after the signature, keeping track of where
+// each one starts so errors can point at the damage
+type chunkReader struct {
+	reader io.Reader
+	opts   *ReadOptions
+	// header holds the length and type of the chunk being read, then its CRC
+	header [8]byte
+	index  int
+	offset int64
+	// size is the length of the whole stream, 0 when it isn't known up front
+	size int64
+}
+
+func newChunkReader(reader io.Reader, opts *ReadOptions) *chunkReader {
+	return &chunkReader{
+		reader: reader,
+		opts:   opts,
+		offset: int64(len(PNGHeader)),
+	}
+}
+
+// next reads the next chunk and verifies its CRC. data, when large enough, is reused to hold the chunk data.
+// A chunk failing its CRC was still read in full, so it is returned along with the error and the
+// reader can carry on with the chunk after it.
+func (r *chunkReader) next(data []byte) (*Chunk, error) {
+	chunk, err := r.read(data)
+	if err != nil {
+		err = &ChunkError{Type: chunk.Type, Index: r.index, Offset: r.offset, Err: err}
+		if !errors.Is(err, ErrorCRCMismatch) {
+			return nil, err
+		}
+	}
+
+	r.index++
+	r.offset += chunkOverhead + int64(chunk.Length)
+	return chunk, err
+}
+
+// read does the work for next, the returned chunk carries as much as was read even on error
+func (r *chunkReader) read(data []byte) (*Chunk, error) {
+	chunk := &Chunk{}
+
+	// every read below must succeed, the stream ending anywhere before
+	// IEND means the file was truncated
+	if _, err := io.ReadFull(r.reader, r.header[:]); err != nil {
+		return chunk, unexpectedEOF(err)
+	}
+	chunk.Length = binary.BigEndian.Uint32(r.header[:4])
+	chunk.Type = string(r.header[4:])
+
+	// checked first, a garbage type explains a garbage length too
+	if !isValidChunkType(chunk.Type) {
+		return chunk, ErrorBadChunkType
+	}
+
+	// length and type are behind us, the data and CRC have to fit in what's left
+	if available := r.size - r.offset - chunkOverhead; r.size > 0 && int64(chunk.Length) > available {
+		if available < 0 {
+			available = 0
+		}
+		return chunk, &MissingBytesError{Expected: chunk.Length, Actual: uint32(available)}
+	}
+
+	limit := r.opts.MaxChunkLength
+	if limit == 0 {
+		limit = DefaultMaxChunkLength
+	}
+	if chunk.Length > limit {
+		return chunk, ErrorChunkTooLarge
+	}
+
+	if uint32(cap(data)) >= chunk.Length {
+		chunk.Data = data[:chunk.Length]
+	} else {
+		chunk.Data = make([]byte, chunk.Length)
+	}
+
+	if _, err := io.ReadFull(r.reader, chunk.Data); err != nil {
+		return chunk, unexpectedEOF(err)
+	}
+
+	if _, err := io.ReadFull(r.reader, r.header[:4]); err != nil {
+		return chunk, unexpectedEOF(err)
+	}
+	chunk.CRC = binary.BigEndian.Uint32(r.header[:4])
+
+	if chunk.checksum() != chunk.CRC {
+		if !r.opts.FixCRC {
+			return chunk, ErrorCRCMismatch
+		}
+		// the data came through in full so only the stored CRC is bad
+		if err := chunk.RepairCRC(); err != nil {
+			return chunk, err
+		}
+	}
+	return chunk, nil
+}
+
+// chunkOffsets lists where each of chunks starts in a file holding them in that order
+func chunkOffsets(chunks []*Chunk) []int64 {
+	offsets := make([]int64, len(chunks))
+	offset := int64(len(PNGHeader))
+	for i, chunk := range chunks {
+		offsets[i] = offset
+		offset += chunkOverhead + int64(chunk.Length)
+	}
+	return offsets
+}
+
+// unexpectedEOF converts a clean io.EOF into io.ErrUnexpectedEOF, used where the
+// stream is not allowed to end
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// newChunk builds a chunk with its length and CRC filled in
+func newChunk(chunkType string, data []byte) *Chunk {
+	chunk := &Chunk{Type: chunkType, Data: data}
+	chunk.UpdateCRC()
+	return chunk
+}
+
+// encode lays out the signature followed by chunks the way they'd be on disk
+func encode(t testing.TB, chunks ...*Chunk) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	buf.Write(PNGHeader)
+	for _, chunk := range chunks {
+		if err := chunk.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// ihdr builds the IHDR of a non interlaced width by height image
+func ihdr(width, height uint32, bitDepth, colorType uint8) *Chunk {
+	data := make([]byte, 13)
+	binary.BigEndian.PutUint32(data[0:], width)
+	binary.BigEndian.PutUint32(data[4:], height)
+	data[8], data[9] = bitDepth, colorType
+	return newChunk("IHDR", data)
+}
+
+// idats compresses rows, each given without its filter byte, and splits the stream over n IDAT chunks
+func idats(t testing.TB, rows [][]byte, n int) []*Chunk {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	for _, row := range rows {
+		w.Write([]byte{0})
+		w.Write(row)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := buf.Bytes()
+	chunks := make([]*Chunk, n)
+	for i := range chunks {
+		start, end := len(stream)*i/n, len(stream)*(i+1)/n
+		chunks[i] = newChunk("IDAT", stream[start:end])
+	}
+	return chunks
+}
+
+// palettePNG is a 4x2 indexed image with three colours, the first one fully transparent,
+// its image data split over three IDAT chunks. A tIME chunk sits at the end for stripping
+// to throw away.
+func palettePNG(t testing.TB) []*Chunk {
+	chunks := []*Chunk{
+		ihdr(4, 2, 8, 3),
+		newChunk("PLTE", []byte{0, 0, 0, 255, 0, 0, 0, 255, 0}),
+		newChunk("tRNS", []byte{0, 128}),
+	}
+	chunks = append(chunks, idats(t, [][]byte{{0, 1, 2, 0}, {2, 1, 0, 1}}, 3)...)
+	return append(chunks, newChunk("tIME", []byte{7, 226, 1, 2, 3, 4, 5}), newChunk("IEND", nil))
+}
+
+// gradientPNG is a 256x256 truecolour image with nothing but IHDR, 64 IDAT chunks and IEND,
+// big enough for benchmarks to measure something
+func gradientPNG(t testing.TB) []*Chunk {
+	rows := make([][]byte, 256)
+	for y := range rows {
+		rows[y] = make([]byte, 256*3)
+		for x := range rows[y] {
+			rows[y][x] = byte(x ^ y)
+		}
+	}
+	chunks := append([]*Chunk{ihdr(256, 256, 8, 2)}, idats(t, rows, 64)...)
+	return append(chunks, newChunk("IEND", nil))
+}
+
+// mustRead parses data, failing the test on any error
+func mustRead(t testing.TB, data []byte) *PNG {
+	t.Helper()
+
+	png, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return png
+}
+
+// chunkTypes lists the types of the chunks in png in file order
+func chunkTypes(png *PNG) []string {
+	types := make([]string, len(png.Order))
+	for i, chunk := range png.Order {
+		types[i] = chunk.Type
+	}
+	return types
+}
+
+func TestReadTruncated(t *testing.T) {
+	data := encode(t, palettePNG(t)...)
+
+	for n := len(PNGHeader); n < len(data); n++ {
+		done := make(chan error, 1)
+		go func() {
+			_, err := Read(bytes.NewReader(data[:n]))
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("first %d of %d bytes: got %v, want io.ErrUnexpectedEOF", n, len(data), err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("first %d of %d bytes: Read hangs", n, len(data))
+		}
+	}
+}
+
+func TestUpdateCRC(t *testing.T) {
+	chunks := palettePNG(t)
+	text := newChunk("tEXt", []byte("Comment\x00before"))
+	chunks = append(chunks[:len(chunks)-1], text, chunks[len(chunks)-1])
+	png := mustRead(t, encode(t, chunks...))
+
+	edited := png.Chunks["tEXt"][0]
+	edited.Data = []byte("Comment\x00a rather longer comment than before")
+	if _, err := edited.Verify(); err == nil {
+		t.Fatal("the edited chunk verifies before UpdateCRC")
+	}
+	edited.UpdateCRC()
+
+	var buf bytes.Buffer
+	if _, err := png.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	reread := mustRead(t, buf.Bytes())
+	got := reread.Chunks["tEXt"][0]
+	if _, err := got.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data, edited.Data) {
+		t.Errorf("tEXt data %q, want %q", got.Data, edited.Data)
+	}
+}
+
+func TestHeaderVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   error
+	}{
+		{"valid", PNGHeader, nil},
+		{"empty", nil, ErrorInvalidHeaderLength},
+		{"short", PNGHeader[:5], ErrorInvalidHeaderLength},
+		{"not png", []byte("GIF89a\x01\x00"), ErrorNotPNG},
+		{"png spelt wrong", []byte{0x89, 'P', 'N', 'X', 0x0d, 0x0a, 0x1a, 0x0a}, ErrorNotPNG},
+		{"bad last byte", []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x00}, ErrorNotPNG},
+		{"dos to unix", append(append([]byte{}, dosToUnixHeader...), 0), ErrorDOSToUnixConversion},
+		{"unix to dos", unixToDOSHeader[:len(PNGHeader)], ErrorUnixToDOSConversion},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := (&Header{test.header}).Verify(); err != test.want {
+				t.Errorf("Verify(%x) = %v, want %v", test.header, err, test.want)
+			}
+		})
+	}
+}
+
+func TestRepairHeader(t *testing.T) {
+	chunks := encode(t, palettePNG(t)...)[len(PNGHeader):]
+
+	tests := []struct {
+		name    string
+		mangled []byte
+	}{
+		{"intact", PNGHeader},
+		{"dos to unix", dosToUnixHeader},
+		{"unix to dos", unixToDOSHeader},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := append(append([]byte{}, test.mangled...), chunks...)
+			repaired, err := RepairHeader(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(repaired, PNGHeader) || !bytes.Equal(repaired[len(PNGHeader):], chunks) {
+				t.Fatalf("repaired file starts %x, want %x", repaired[:len(PNGHeader)], PNGHeader)
+			}
+			mustRead(t, repaired)
+		})
+	}
+
+	if _, err := RepairHeader([]byte("GIF89a\x01\x00\x01\x00")); err != ErrorNotPNG {
+		t.Errorf("repairing a GIF: got %v, want %v", err, ErrorNotPNG)
+	}
+}
+
+// BenchmarkRead compares Read, which allocates the data of every chunk it returns, against Verify,
+// which reuses pooled reader and data buffers and only allocates the chunk headers
+func BenchmarkRead(b *testing.B) {
+	data := encode(b, gradientPNG(b)...)
+
+	b.Run("Read", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if _, err := Read(bytes.NewReader(data)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Verify", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if err := Verify(bytes.NewReader(data)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestReadMaxChunkLength(t *testing.T) {
+	data := encode(t, palettePNG(t)...)
+
+	// the IHDR is the biggest chunk at 13 bytes
+	if _, err := ReadWithOptions(bytes.NewReader(data), ReadOptions{MaxChunkLength: 8}); !errors.Is(err, ErrorChunkTooLarge) {
+		t.Errorf("with an 8 byte limit: got %v, want %v", err, ErrorChunkTooLarge)
+	}
+	if _, err := ReadWithOptions(bytes.NewReader(data), ReadOptions{MaxChunkLength: 13}); err != nil {
+		t.Errorf("with a 13 byte limit: %v", err)
+	}
+
+	huge := encode(t, ihdr(1, 1, 8, 0))
+	huge = append(huge, 0xff, 0xff, 0xff, 0xff, 'I', 'D', 'A', 'T')
+	if _, err := Read(bytes.NewReader(huge)); !errors.Is(err, ErrorChunkTooLarge) {
+		t.Errorf("a 4GB chunk with the default limit: got %v, want %v", err, ErrorChunkTooLarge)
+	}
+}
+
+// shortWriter takes the first n bytes written to it, then fails
+type shortWriter struct {
+	n int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		written := w.n
+		w.n = 0
+		return written, io.ErrShortWrite
+	}
+	w.n -= len(b)
+	return len(b), nil
+}
+
+func TestWriteToCountsPartialWrites(t *testing.T) {
+	png := mustRead(t, encode(t, palettePNG(t)...))
+	size := len(encode(t, palettePNG(t)...))
+
+	// inside the signature, the first chunk's length and the middle of the image data
+	for _, limit := range []int{3, 10, 60, size} {
+		n, err := png.WriteTo(&shortWriter{n: limit})
+		if n != int64(limit) {
+			t.Errorf("a writer taking %d bytes: WriteTo returned %d", limit, n)
+		}
+		if (err == nil) != (limit == size) {
+			t.Errorf("a writer taking %d of %d bytes: got %v", limit, size, err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var ErrorQuantizeColors = errors.New("palettes hold between 2 and 256 colours")
+
+// colorCount is one distinct RGBA colour of an image and how many pixels use it
+type colorCount struct {
+	rgba  [4]uint8
+	count int
+}
+
+// colorBox is a box of the median cut, a run of colours sharing one palette entry
+type colorBox []colorCount
+
+//Quantize reduces a truecolour image to an indexed one of at most colors colours using median cut,
+//images with no more colours than that come through unchanged but indexed. This is lossy.
+//PLTE and tRNS are rebuilt while sBIT, bKGD and hIST, whose layout depends on the colour type,
+//are dropped. Images that aren't truecolour are left alone and animated PNGs return ErrorAnimated,
+//their frames would still hold truecolour data.
+func (p *PNG) Quantize(colors int) error {
+	if colors < 2 || colors > 256 {
+		return ErrorQuantizeColors
+	}
+
+	_, _, _, colorType, _, _, _, err := p.IHDR()
+	if err != nil {
+		return err
+	}
+
+	if colorType != 2 && colorType != 6 {
+		return nil
+	}
+
+	if p.animated() {
+		return ErrorAnimated
+	}
+
+	img, err := p.decodeImageData()
+	if err != nil {
+		return err
+	}
+
+	// a truecolour tRNS names the one colour that is fully transparent
+	var key []byte
+	if chunks := p.Chunks["tRNS"]; img.colorType == 2 && len(chunks) > 0 && len(chunks[0].Data) == 6 {
+		key = chunks[0].Data
+	}
+
+	counts := map[[4]uint8]int{}
+	pixels := make([][][4]uint8, len(img.passes))
+	for i, pass := range img.passes {
+		pixels[i] = make([][4]uint8, 0, int(pass.width)*int(pass.height))
+		for _, row := range pass.rows {
+			for x := 0; x < int(pass.width); x++ {
+				rgba := img.rgba(row, x, key)
+				counts[rgba]++
+				pixels[i] = append(pixels[i], rgba)
+			}
+		}
+	}
+
+	if len(counts) == 0 {
+		return ErrorImageDataSize
+	}
+
+	boxes := medianCut(counts, colors)
+
+	// transparent entries go first so tRNS stays as short as possible
+	palette := make([][4]uint8, len(boxes))
+	for i, box := range boxes {
+		palette[i] = box.mean()
+	}
+	order := make([]int, len(boxes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return palette[order[i]][3] < palette[order[j]][3] })
+
+	index := map[[4]uint8]byte{}
+	sorted := make([][4]uint8, len(order))
+	for n, i := range order {
+		sorted[n] = palette[i]
+		for _, color := range boxes[i] {
+			index[color.rgba] = byte(n)
+		}
+	}
+	palette = sorted
+
+	indexed := &imageData{
+		width:        img.width,
+		height:       img.height,
+		bitDepth:     8,
+		colorType:    3,
+		bitsPerPixel: 8,
+	}
+	for i, src := range img.passes {
+		out := &pass{width: src.width, height: src.height, rows: make([][]byte, len(src.rows))}
+		for y := range src.rows {
+			row := make([]byte, src.width)
+			for x := range row {
+				row[x] = index[pixels[i][y*int(src.width)+x]]
+			}
+			out.rows[y] = row
+		}
+		indexed.passes = append(indexed.passes, out)
+	}
+
+	data, err := indexed.encode()
+	if err != nil {
+		return err
+	}
+
+	ihdr := p.Chunks["IHDR"][0]
+	ihdr.Data[8], ihdr.Data[9] = 8, 3
+	ihdr.UpdateCRC()
+
+	for _, chunkType := range []string{"PLTE", "tRNS", "sBIT", "bKGD", "hIST"} {
+		p.removeChunks(chunkType)
+	}
+
+	plte := &Chunk{Type: "PLTE"}
+	var alpha []byte
+	for _, color := range palette {
+		plte.Data = append(plte.Data, color[0], color[1], color[2])
+		if color[3] != 255 {
+			alpha = append(alpha, color[3])
+		}
+	}
+	plte.UpdateCRC()
+	added := []*Chunk{plte}
+
+	if len(alpha) > 0 {
+		trns := &Chunk{Type: "tRNS", Data: alpha}
+		trns.UpdateCRC()
+		added = append(added, trns)
+	}
+
+	p.insertBefore("IDAT", added...)
+	p.replaceImageData(data)
+	return nil
+}
+
+// rgba reads pixel x of a truecolour row as 8 bit RGBA, 16 bit samples keep their high byte.
+// Pixels matching key, a truecolour tRNS, come out fully transparent.
+func (img *imageData) rgba(row []byte, x int, key []byte) [4]uint8 {
+	samples := img.bitsPerPixel / int(img.bitDepth)
+	var rgba [4]uint8
+	rgba[3] = 255
+
+	if img.bitDepth == 16 {
+		pixel := row[x*samples*2 : (x+1)*samples*2]
+		for i := 0; i < samples; i++ {
+			rgba[i] = pixel[i*2]
+		}
+		if key != nil && binary.BigEndian.Uint16(pixel[0:2]) == binary.BigEndian.Uint16(key[0:2]) &&
+			binary.BigEndian.Uint16(pixel[2:4]) == binary.BigEndian.Uint16(key[2:4]) &&
+			binary.BigEndian.Uint16(pixel[4:6]) == binary.BigEndian.Uint16(key[4:6]) {
+			rgba[3] = 0
+		}
+		return rgba
+	}
+
+	copy(rgba[:], row[x*samples:(x+1)*samples])
+	// the key is stored as 16 bit samples even for 8 bit images
+	if key != nil && rgba[0] == key[1] && rgba[1] == key[3] && rgba[2] == key[5] && key[0]|key[2]|key[4] == 0 {
+		rgba[3] = 0
+	}
+	return rgba
+}
+
+// medianCut splits the colours into at most n boxes, each time halving the box whose colours
+// spread the furthest along one channel at the pixel weighted median
+func medianCut(counts map[[4]uint8]int, n int) []colorBox {
+	all := make(colorBox, 0, len(counts))
+	for rgba, count := range counts {
+		all = append(all, colorCount{rgba, count})
+	}
+	// map order would make the palette differ from run to run
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i].rgba, all[j].rgba
+		return binary.BigEndian.Uint32(a[:]) < binary.BigEndian.Uint32(b[:])
+	})
+
+	boxes := []colorBox{all}
+	for len(boxes) < n {
+		widest, channel, spread := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if c, s := box.widestChannel(); s > spread {
+				widest, channel, spread = i, c, s
+			}
+		}
+
+		// every box is down to a single colour
+		if widest < 0 {
+			break
+		}
+
+		box := boxes[widest]
+		sort.SliceStable(box, func(i, j int) bool { return box[i].rgba[channel] < box[j].rgba[channel] })
+
+		total := 0
+		for _, color := range box {
+			total += color.count
+		}
+
+		split, seen := 1, box[0].count
+		for ; split < len(box)-1 && seen < total/2; split++ {
+			seen += box[split].count
+		}
+
+		boxes[widest] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+	return boxes
+}
+
+// widestChannel finds the channel with the largest range of values in the box
+func (b colorBox) widestChannel() (int, int) {
+	channel, spread := 0, -1
+	for c := 0; c < 4; c++ {
+		low, high := 255, 0
+		for _, color := range b {
+			v := int(color.rgba[c])
+			if v < low {
+				low = v
+			}
+			if v > high {
+				high = v
+			}
+		}
+		if high-low > spread {
+			channel, spread = c, high-low
+		}
+	}
+	return channel, spread
+}
+
+// mean is the pixel weighted average colour of the box
+func (b colorBox) mean() [4]uint8 {
+	var sums [4]int
+	total := 0
+	for _, color := range b {
+		for c := range sums {
+			sums[c] += int(color.rgba[c]) * color.count
+		}
+		total += color.count
+	}
+
+	var mean [4]uint8
+	for c := range mean {
+		mean[c] = uint8((sums[c] + total/2) / total)
+	}
+	return mean
+}
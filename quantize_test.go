@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	imagepng "image/png"
+	"testing"
+)
+
+// rgbPNG is a 4x2 truecolour image with five colours
+func rgbPNG(t *testing.T) []*Chunk {
+	rows := [][]byte{
+		{255, 0, 0, 0, 255, 0, 0, 0, 255, 255, 0, 0},
+		{0, 0, 0, 255, 255, 255, 0, 255, 0, 255, 0, 0},
+	}
+	chunks := append([]*Chunk{ihdr(4, 2, 8, 2)}, idats(t, rows, 1)...)
+	return append(chunks, newChunk("IEND", nil))
+}
+
+func TestQuantize(t *testing.T) {
+	png := mustRead(t, encode(t, rgbPNG(t)...))
+	if err := png.Quantize(4); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := png.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := imagepng.Decode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, colorType, _, _, _, _ := png.IHDR(); colorType != 3 {
+		t.Errorf("colour type %d after quantizing, want 3", colorType)
+	}
+
+	animated := encode(t, animate(t, rgbPNG(t))...)
+	png = mustRead(t, animated)
+	if err := png.Quantize(4); err != ErrorAnimated {
+		t.Fatalf("quantizing an APNG: got %v, want %v", err, ErrorAnimated)
+	}
+
+	var unchanged bytes.Buffer
+	if _, err := png.WriteTo(&unchanged); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unchanged.Bytes(), animated) {
+		t.Errorf("the APNG changed")
+	}
+}
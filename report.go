@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	statusOK      = "ok"
+	statusSkipped = "skipped"
+	statusError   = "error"
+	// statusBroken marks the damaged files -only-broken copied
+	statusBroken = "broken"
+)
+
+// result is the outcome of processing a single file, as written to the -report file
+type result struct {
+	Input         string   `json:"input"`
+	Output        string   `json:"output,omitempty"`
+	Status        string   `json:"status"`
+	OriginalSize  int64    `json:"original_size"`
+	StrippedSize  int64    `json:"stripped_size"`
+	ChunksRemoved []string `json:"chunks_removed,omitempty"`
+	TrailingBytes int64    `json:"trailing_bytes,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// manifestEntry records where an input ended up, as written to the -manifest file
+type manifestEntry struct {
+	Output string `json:"output"`
+	Format string `json:"format"`
+}
+
+// metrics is the throughput of a whole run, as written to the -metrics file
+type metrics struct {
+	Files          int     `json:"files"`
+	Failed         int64   `json:"failed"`
+	OriginalBytes  int64   `json:"original_bytes"`
+	StrippedBytes  int64   `json:"stripped_bytes"`
+	Seconds        float64 `json:"seconds"`
+	FilesPerSecond float64 `json:"files_per_second"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// collectResults drains results until the channel is closed, then writes them all to reportPath
+// as a JSON array and the inputs with an output to manifestPath as a JSON object, skipping either
+// when its path is empty. The outcome of the writes is sent on the returned channel.
+func collectResults(reportPath, manifestPath string, results <-chan *result) <-chan error {
+	written := make(chan error, 1)
+
+	go func() {
+		report := []*result{}
+		for res := range results {
+			report = append(report, res)
+		}
+
+		var err error
+		if reportPath != "" {
+			err = writeJSON(reportPath, report)
+		}
+
+		if manifestPath != "" && err == nil {
+			manifest := map[string]manifestEntry{}
+			for _, res := range report {
+				if res.Output != "" {
+					format := strings.TrimPrefix(filepath.Ext(res.Output), ".")
+					manifest[res.Input] = manifestEntry{Output: res.Output, Format: format}
+				}
+			}
+
+			if err = writeJSON(manifestPath, manifest); err != nil {
+				err = fmt.Errorf("manifest: %w", err)
+			}
+		}
+		written <- err
+	}()
+
+	return written
+}
+
+// writeJSON writes v to path as indented JSON
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
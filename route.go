@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// colorTypes maps the names -route accepts to IHDR colour types
+var colorTypes = map[string]uint8{
+	"gray":      0,
+	"rgb":       2,
+	"indexed":   3,
+	"grayalpha": 4,
+	"rgba":      6,
+}
+
+// route sends the images of one colour type, and optionally one bit depth, to an output format
+type route struct {
+	colorType uint8
+	// bitDepth is 0 to match every bit depth
+	bitDepth uint8
+	compress bool
+}
+
+// parseRoutes parses the -route rules, a comma separated list of type=format where type is a colour
+// type name optionally followed by :depth and format is png or compress, e.g. gray=png,rgb:8=compress
+func parseRoutes(list string) ([]route, error) {
+	var routes []route
+	for _, rule := range strings.Split(list, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+
+		i := strings.Index(rule, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%q doesn't look like type=format", rule)
+		}
+		selector, format := rule[:i], rule[i+1:]
+
+		name, depth := selector, ""
+		if j := strings.Index(selector, ":"); j >= 0 {
+			name, depth = selector[:j], selector[j+1:]
+		}
+
+		colorType, ok := colorTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("%q: unknown colour type %q, pick gray, rgb, indexed, grayalpha or rgba", rule, name)
+		}
+		r := route{colorType: colorType}
+
+		if depth != "" {
+			n, err := strconv.Atoi(depth)
+			if err != nil || n < 0 || n > 16 || !validBitDepth(colorType, uint8(n)) {
+				return nil, fmt.Errorf("%q: bad bit depth %q for %s", rule, depth, name)
+			}
+			r.bitDepth = uint8(n)
+		}
+
+		switch format {
+		case "png":
+		case "compress":
+			r.compress = true
+		default:
+			return nil, fmt.Errorf("%q: unknown format %q, pick png or compress", rule, format)
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// routeCompresses reports whether png should be compressed, going by the first of routes matching its
+// IHDR. Images no route matches, or without a readable IHDR, get fallback.
+func routeCompresses(png *PNG, routes []route, fallback bool) bool {
+	_, _, bitDepth, colorType, _, _, _, err := png.IHDR()
+	if err != nil {
+		return fallback
+	}
+
+	for _, r := range routes {
+		if r.colorType == colorType && (r.bitDepth == 0 || r.bitDepth == bitDepth) {
+			return r.compress
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// apngChunks carry the animation of an APNG, the frames reference each other by sequence number
+var apngChunks = []string{"acTL", "fcTL", "fdAT"}
+
+// colorChunks describe how the samples map to colours, without them wide gamut images render wrong
+var colorChunks = []string{"gAMA", "cHRM", "sRGB", "iCCP"}
+
+//StripOptions controls which chunks Strip copies to its output
+type StripOptions struct {
+	// Keep lists the ancillary chunk types kept, critical chunks such as IHDR, PLTE, IDAT and IEND
+	// are always kept whatever Keep and Strip say since the image can't be decoded without them
+	Keep map[string]bool
+	// KeepSafeToCopy also keeps every ancillary chunk with the safe-to-copy bit set, the spec's own
+	// rule for what an editor may carry over
+	KeepSafeToCopy bool
+	// Strip, when non nil, lists the ancillary chunk types to remove and every other chunk is kept.
+	// Keep is ignored when Strip is set.
+	Strip map[string]bool
+	// DropCorrupt throws away ancillary chunks failing their CRC, as left behind by ReadLenient,
+	// instead of copying them through. A critical chunk failing its CRC fails the strip, the image
+	// can't do without it.
+	DropCorrupt bool
+	// Check validates the chunk layout and verifies the CRC of every kept chunk before it is written
+	Check bool
+	// MergeIDAT joins each run of consecutive IDAT chunks into a single chunk, saving 12 bytes of
+	// overhead per chunk. IDAT boundaries are arbitrary so the zlib stream is unchanged.
+	MergeIDAT bool
+	// Filter, when non nil, is asked about every ancillary chunk the lists above keep and drops
+	// it by returning false, e.g. to keep tEXt only for some keywords. Critical chunks are always
+	// kept, the image can't be decoded without them.
+	Filter func(*Chunk) bool
+	// Transform, when non nil, is given a copy of every ancillary chunk about to be written and
+	// returns the chunk to write in its place, or nil to drop it. It may change the copy and return
+	// it, the length and CRC of whatever it returns are recomputed when it differs from the chunk
+	// read. Critical chunks are written as they are.
+	Transform func(*Chunk) (*Chunk, error)
+}
+
+//KeepAll makes sure every chunk type listed survives stripping, whether Keep or Strip is in use
+func (o *StripOptions) KeepAll(chunkTypes ...string) {
+	if o.Keep == nil {
+		o.Keep = map[string]bool{}
+	}
+
+	for _, chunkType := range chunkTypes {
+		o.Keep[chunkType] = true
+		delete(o.Strip, chunkType)
+	}
+}
+
+//Keeps reports whether a chunk of the given type belongs in the stripped output
+func (o *StripOptions) Keeps(chunkType string) bool {
+	chunk := &Chunk{Type: chunkType}
+	if chunk.IsCritical() {
+		return true
+	}
+
+	if o.Strip != nil {
+		return !o.Strip[chunkType]
+	}
+
+	if o.KeepSafeToCopy && chunk.IsSafeToCopy() {
+		return true
+	}
+	return o.Keep[chunkType]
+}
+
+//KeepsChunk reports whether chunk belongs in the stripped output, asking Filter about whatever
+//Keeps lets through. Empty IDAT chunks are always dropped, some encoders pad with them but they
+//add nothing to the image data and confuse some decoders.
+func (o *StripOptions) KeepsChunk(chunk *Chunk) bool {
+	if !o.Keeps(chunk.Type) || (chunk.Type == "IDAT" && len(chunk.Data) == 0) {
+		return false
+	}
+	return o.Filter == nil || chunk.IsCritical() || o.Filter(chunk)
+}
+
+//KeepsAll reports whether Strip would copy every chunk of p through untouched, writing out the
+//same chunks p was read from
+func (o *StripOptions) KeepsAll(p *PNG) bool {
+	// there's no telling what it rewrites
+	if o.Transform != nil {
+		return false
+	}
+
+	if o.MergeIDAT && len(p.Chunks["IDAT"]) > 1 {
+		return false
+	}
+
+	for _, chunk := range p.chunks() {
+		if !o.KeepsChunk(chunk) {
+			return false
+		}
+
+		if o.DropCorrupt && !chunk.IsCritical() {
+			if _, err := chunk.Verify(); err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//Strip writes p to w, throwing away every chunk opts doesn't keep
+func Strip(p *PNG, w io.Writer, opts StripOptions) error {
+	if opts.Check {
+		if errs := p.Validate(); len(errs) > 0 {
+			return errs[0]
+		}
+	}
+
+	if _, err := w.Write(PNGHeader); err != nil {
+		return err
+	}
+
+	// walk the chunks in file order so IHDR, PLTE, IDAT and IEND keep their
+	// relative positions in the output
+	order := p.chunks()
+	for i := 0; i < len(order); i++ {
+		chunk := order[i]
+		if !opts.KeepsChunk(chunk) {
+			continue
+		}
+
+		if opts.DropCorrupt {
+			if _, err := chunk.Verify(); err != nil {
+				if chunk.IsCritical() {
+					return &ChecksumError{ChunkType: chunk.Type, Err: err}
+				}
+				// the image doesn't need ancillary chunks
+				continue
+			}
+		}
+
+		if opts.Check {
+			if _, err := chunk.Verify(); err != nil {
+				return &ChecksumError{ChunkType: chunk.Type, Err: err}
+			}
+		}
+
+		if opts.Transform != nil && !chunk.IsCritical() {
+			// p keeps the chunk it was read with whatever the transform does to its copy
+			c := *chunk
+			c.Data = append([]byte(nil), chunk.Data...)
+			transformed, err := opts.Transform(&c)
+			if err != nil {
+				return fmt.Errorf("transforming %s chunk %d: %w", chunk.Type, i, err)
+			}
+
+			if transformed == nil {
+				continue
+			}
+
+			// an untouched chunk keeps its CRC, good or bad
+			if !transformed.Equal(chunk) {
+				transformed.UpdateCRC()
+			}
+			chunk = transformed
+		}
+
+		if opts.MergeIDAT && chunk.Type == "IDAT" {
+			merged, n, err := mergeIDAT(order[i:])
+			if err != nil {
+				return err
+			}
+			chunk, i = merged, i+n-1
+		}
+
+		if err := chunk.Write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeIDAT joins the IDAT chunks at the start of order into one, returning it along with the
+// number of chunks merged. Every one of them is verified first, the merged chunk gets a fresh CRC
+// that would otherwise hide any damage.
+func mergeIDAT(order []*Chunk) (*Chunk, int, error) {
+	n, size := 0, 0
+	for ; n < len(order) && order[n].Type == "IDAT"; n++ {
+		if _, err := order[n].Verify(); err != nil {
+			return nil, 0, &ChecksumError{ChunkType: order[n].Type, Err: err}
+		}
+		size += len(order[n].Data)
+	}
+
+	if n == 1 {
+		return order[0], 1, nil
+	}
+
+	merged := &Chunk{Type: "IDAT", Data: make([]byte, 0, size)}
+	for _, chunk := range order[:n] {
+		merged.Data = append(merged.Data, chunk.Data...)
+	}
+	merged.UpdateCRC()
+	return merged, n, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	imagepng "image/png"
+	"strings"
+	"testing"
+)
+
+// defaultStripOptions are the options the command line builds without -keep or -strip
+func defaultStripOptions() StripOptions {
+	return StripOptions{Keep: parseChunkList("PLTE,tRNS"), KeepSafeToCopy: true}
+}
+
+// stripped runs Strip over data and parses the result
+func stripped(t *testing.T, data []byte, opts StripOptions) (*PNG, []byte) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := Strip(mustRead(t, data), &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	return mustRead(t, buf.Bytes()), buf.Bytes()
+}
+
+func TestStripKeepsTRNS(t *testing.T) {
+	input := palettePNG(t)
+	trns := input[2]
+
+	for name, opts := range map[string]StripOptions{
+		"default":   defaultStripOptions(),
+		"whitelist": {Keep: parseChunkList("PLTE,tRNS")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			png, data := stripped(t, encode(t, input...), opts)
+
+			kept := png.Chunks["tRNS"]
+			if len(kept) != 1 || !kept[0].Equal(trns) {
+				t.Fatalf("tRNS chunks after stripping: %v, want %v", kept, trns)
+			}
+			if len(png.Chunks["tIME"]) != 0 {
+				t.Errorf("tIME survived stripping")
+			}
+
+			img, err := imagepng.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+				t.Errorf("pixel 0,0 has alpha %d, want it transparent", a)
+			}
+			if _, _, _, a := img.At(1, 0).RGBA(); a != 128*0x101 {
+				t.Errorf("pixel 1,0 has alpha %d, want %d", a, 128*0x101)
+			}
+		})
+	}
+}
+
+func TestStripKeepsFileOrder(t *testing.T) {
+	input := palettePNG(t)
+	want := encode(t, input[:len(input)-2]...)
+	want = append(want, encode(t, input[len(input)-1])[len(PNGHeader):]...)
+
+	// map iteration changes from run to run, so give a wrong order every chance to show up
+	for i := 0; i < 20; i++ {
+		_, data := stripped(t, encode(t, input...), defaultStripOptions())
+		if !bytes.Equal(data, want) {
+			t.Fatalf("stripped output\n%x\nwant\n%x", data, want)
+		}
+	}
+}
+
+func TestStripMergeIDAT(t *testing.T) {
+	input := palettePNG(t)
+	opts := defaultStripOptions()
+	opts.MergeIDAT = true
+	png, data := stripped(t, encode(t, input...), opts)
+
+	idat := png.Chunks["IDAT"]
+	if len(idat) != 1 {
+		t.Fatalf("%d IDAT chunks after merging, want 1: %v", len(idat), chunkTypes(png))
+	}
+
+	var stream []byte
+	for _, chunk := range input[3:6] {
+		stream = append(stream, chunk.Data...)
+	}
+	if !bytes.Equal(idat[0].Data, stream) {
+		t.Errorf("merged IDAT holds %x, want %x", idat[0].Data, stream)
+	}
+
+	if _, err := imagepng.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"IHDR", "PLTE", "tRNS", "IDAT", "IEND"}; strings.Join(chunkTypes(png), ",") != strings.Join(want, ",") {
+		t.Errorf("chunks after merging %v, want %v", chunkTypes(png), want)
+	}
+}
+
+func TestStripEmptyIDAT(t *testing.T) {
+	input := palettePNG(t)
+	empty := newChunk("IDAT", nil)
+	if _, err := empty.Verify(); err != nil {
+		t.Fatalf("an empty IDAT fails to verify: %v", err)
+	}
+
+	// between the first and second IDAT of the run
+	input = append(input[:4], append([]*Chunk{empty}, input[4:]...)...)
+
+	for _, merge := range []bool{false, true} {
+		opts := defaultStripOptions()
+		opts.MergeIDAT = merge
+		png, data := stripped(t, encode(t, input...), opts)
+
+		want := 3
+		if merge {
+			want = 1
+		}
+		if n := len(png.Chunks["IDAT"]); n != want {
+			t.Errorf("merging %t: %d IDAT chunks, want %d", merge, n, want)
+		}
+		for _, chunk := range png.Chunks["IDAT"] {
+			if len(chunk.Data) == 0 {
+				t.Errorf("merging %t: the empty IDAT was written", merge)
+			}
+		}
+
+		if _, err := imagepng.Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("merging %t: %v", merge, err)
+		}
+	}
+}
+
+func TestStripKeepPhys(t *testing.T) {
+	input := palettePNG(t)
+	phys := newChunk("pHYs", []byte{0, 0, 0x0b, 0x13, 0, 0, 0x0b, 0x13, 1})
+	input = append(input[:3], append([]*Chunk{phys}, input[3:]...)...)
+
+	tests := map[string]StripOptions{
+		"keep":  {Keep: parseChunkList("PLTE,tRNS")},
+		"strip": {Strip: parseChunkList("pHYs,tIME")},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			// the lists on their own get rid of it
+			if png, _ := stripped(t, encode(t, input...), opts); len(png.Chunks["pHYs"]) != 0 {
+				t.Fatal("pHYs survived without -keep-phys")
+			}
+
+			opts.KeepAll("pHYs")
+			png, _ := stripped(t, encode(t, input...), opts)
+			if kept := png.Chunks["pHYs"]; len(kept) != 1 || !kept[0].Equal(phys) {
+				t.Errorf("pHYs chunks with -keep-phys: %v, want %v", kept, phys)
+			}
+		})
+	}
+}
+
+func TestStripDropCorrupt(t *testing.T) {
+	input := palettePNG(t)
+	// damage the tIME and second IDAT, Strip is handed chunks the way ReadLenient leaves them
+	input[6].CRC ^= 1
+	png := &PNG{Chunks: map[string][]*Chunk{}, Order: input}
+	for _, chunk := range input {
+		png.Chunks[chunk.Type] = append(png.Chunks[chunk.Type], chunk)
+	}
+
+	opts := defaultStripOptions()
+	opts.DropCorrupt = true
+	var buf bytes.Buffer
+	if err := Strip(png, &buf, opts); err != nil {
+		t.Fatalf("dropping a damaged tIME: %v", err)
+	}
+
+	input[4].CRC ^= 1
+	for _, merge := range []bool{false, true} {
+		opts.MergeIDAT = merge
+		var checksumErr *ChecksumError
+		if err := Strip(png, &bytes.Buffer{}, opts); !errors.As(err, &checksumErr) || checksumErr.ChunkType != "IDAT" {
+			t.Errorf("merging %t: got %v, want the damaged IDAT to fail the strip", merge, err)
+		}
+	}
+}
+
+func TestStripKeepsCriticalChunks(t *testing.T) {
+	input := palettePNG(t)
+
+	for name, opts := range map[string]StripOptions{
+		"keep without PLTE": {Keep: parseChunkList("tRNS")},
+		"strip PLTE":        {Strip: parseChunkList("PLTE,IDAT,tIME")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			png, data := stripped(t, encode(t, input...), opts)
+			if len(png.Chunks["PLTE"]) != 1 || len(png.Chunks["IDAT"]) != 3 {
+				t.Fatalf("chunks after stripping %v, want PLTE and every IDAT kept", chunkTypes(png))
+			}
+			if _, err := imagepng.Decode(bytes.NewReader(data)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestStripTransform(t *testing.T) {
+	input := palettePNG(t)
+	png := mustRead(t, encode(t, input...))
+	trns := png.Chunks["tRNS"][0]
+	original := *trns
+	original.Data = append([]byte(nil), trns.Data...)
+
+	var buf bytes.Buffer
+	opts := defaultStripOptions()
+	opts.Transform = func(chunk *Chunk) (*Chunk, error) {
+		chunk.Data[1] = 255
+		return chunk, nil
+	}
+	if err := Strip(png, &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if !trns.Equal(&original) {
+		t.Errorf("the input tRNS became %v, want it left as %v", trns, &original)
+	}
+	out := mustRead(t, buf.Bytes()).Chunks["tRNS"][0]
+	if !bytes.Equal(out.Data, []byte{0, 255}) {
+		t.Errorf("transformed tRNS holds %x, want 00ff", out.Data)
+	}
+
+	// a chunk handed back as it was keeps its CRC, even a bad one
+	text := newChunk("tEXt", []byte("Comment\x00damaged"))
+	text.CRC ^= 1
+	png = &PNG{Chunks: map[string][]*Chunk{}, Order: append(input[:len(input)-1:len(input)-1], text, input[len(input)-1])}
+	for _, chunk := range png.Order {
+		png.Chunks[chunk.Type] = append(png.Chunks[chunk.Type], chunk)
+	}
+
+	buf.Reset()
+	opts = StripOptions{Strip: map[string]bool{}}
+	opts.Transform = func(chunk *Chunk) (*Chunk, error) { return chunk, nil }
+	if err := Strip(png, &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrorCRCMismatch) {
+		t.Errorf("reading the output back: got %v, want the bad tEXt CRC to survive", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// templateTokens are the placeholders -out-template can use
+var templateTokens = []string{"{dir}", "{name}", "{ext}"}
+
+// checkTemplate makes sure an -out-template names each file and stays inside the output directory
+func checkTemplate(template string) error {
+	if !strings.Contains(template, "{name}") {
+		return fmt.Errorf("%q doesn't use {name}, every file would get the same output", template)
+	}
+
+	rest := template
+	for _, token := range templateTokens {
+		rest = strings.Replace(rest, token, "", -1)
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("%q has an unknown token, pick from %s", template, strings.Join(templateTokens, ", "))
+	}
+
+	if climbs(template) {
+		return fmt.Errorf("%q leaves the output directory", template)
+	}
+	return nil
+}
+
+// climbs reports whether path has a ".." segment, which could take it out of the directory it's
+// joined to
+func climbs(path string) bool {
+	for _, segment := range strings.Split(filepath.ToSlash(path), "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// expandTemplate fills in template for the input at rel, its path below the directory it was found in.
+// {dir} is the directory part of rel, {name} the file name without its extension and {ext} the
+// extension with its dot.
+func expandTemplate(template, rel string) string {
+	dir := filepath.ToSlash(filepath.Dir(rel))
+	if dir == "." {
+		dir = ""
+	}
+
+	ext := filepath.Ext(rel)
+	name := strings.TrimSuffix(filepath.Base(rel), ext)
+
+	expanded := strings.NewReplacer("{dir}", dir, "{name}", name, "{ext}", ext).Replace(template)
+	return filepath.Clean(filepath.FromSlash(expanded))
+}
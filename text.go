@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	ErrorInvalidText  = errors.New("invalid text chunk")
+	ErrorTextTooLarge = errors.New("text exceeds the maximum length")
+)
+
+//DefaultMaxTextLength is the longest TextMetadata inflates the text of a zTXt or iTXt chunk to
+//unless TextOptions.MaxTextLength says otherwise, a few compressed bytes can otherwise inflate
+//to gigabytes
+const DefaultMaxTextLength int64 = 1 << 20
+
+//TextOptions changes how TextMetadataWithOptions decodes text chunks
+type TextOptions struct {
+	// MaxTextLength is the longest a compressed text may inflate to, zero meaning DefaultMaxTextLength
+	MaxTextLength int64
+}
+
+//TextMetadata decodes the tEXt, zTXt and iTXt chunks into keyword/text pairs.
+//When a keyword appears more than once the last chunk wins.
+func (p *PNG) TextMetadata() (map[string]string, error) {
+	return p.TextMetadataWithOptions(TextOptions{})
+}
+
+//TextMetadataWithOptions decodes the text chunks like TextMetadata, the way opts asks for
+func (p *PNG) TextMetadataWithOptions(opts TextOptions) (map[string]string, error) {
+	limit := opts.MaxTextLength
+	if limit == 0 {
+		limit = DefaultMaxTextLength
+	}
+	metadata := map[string]string{}
+
+	for _, chunk := range p.chunks() {
+		var keyword, text string
+		var err error
+
+		switch chunk.Type {
+		case "tEXt":
+			keyword, text, err = decodeText(chunk.Data)
+		case "zTXt":
+			keyword, text, err = decodeCompressedText(chunk.Data, limit)
+		case "iTXt":
+			keyword, text, err = decodeInternationalText(chunk.Data, limit)
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s chunk: %w", chunk.Type, err)
+		}
+		metadata[keyword] = text
+	}
+	return metadata, nil
+}
+
+//AddText adds a tEXt chunk holding keyword and value just before IEND, or last when there is no
+//IEND. Both are stored as Latin-1, the keyword must be 1 to 79 characters without leading,
+//trailing or double spaces.
+func (p *PNG) AddText(keyword, value string) error {
+	if len(keyword) == 0 || len([]rune(keyword)) > 79 || strings.TrimSpace(keyword) != keyword || strings.Contains(keyword, "  ") {
+		return fmt.Errorf("%w: bad keyword %q", ErrorInvalidText, keyword)
+	}
+
+	key, ok := toLatin1(keyword)
+	if !ok || bytes.IndexByte(key, 0) >= 0 {
+		return fmt.Errorf("%w: keyword %q isn't Latin-1", ErrorInvalidText, keyword)
+	}
+
+	text, ok := toLatin1(value)
+	if !ok || bytes.IndexByte(text, 0) >= 0 {
+		return fmt.Errorf("%w: text for %q isn't Latin-1", ErrorInvalidText, keyword)
+	}
+
+	chunk := &Chunk{Type: "tEXt", Data: append(append(key, 0), text...)}
+	chunk.UpdateCRC()
+	p.insertBefore("IEND", chunk)
+	return nil
+}
+
+// decodeText decodes keyword\0text, both Latin-1
+func decodeText(data []byte) (string, string, error) {
+	keyword, text, ok := cutNull(data)
+	if !ok {
+		return "", "", ErrorInvalidText
+	}
+	return latin1(keyword), latin1(text), nil
+}
+
+// decodeCompressedText decodes keyword\0 method compressed-text, the text being zlib compressed Latin-1
+// inflating to at most limit bytes
+func decodeCompressedText(data []byte, limit int64) (string, string, error) {
+	keyword, rest, ok := cutNull(data)
+	if !ok || len(rest) == 0 {
+		return "", "", ErrorInvalidText
+	}
+
+	text, err := inflateText(rest[0], rest[1:], limit)
+	if err != nil {
+		return "", "", err
+	}
+	return latin1(keyword), latin1(text), nil
+}
+
+// decodeInternationalText decodes keyword\0 flag method language\0 translated-keyword\0 text,
+// the text being UTF-8 and zlib compressed when flag is set, inflating to at most limit bytes
+func decodeInternationalText(data []byte, limit int64) (string, string, error) {
+	keyword, rest, ok := cutNull(data)
+	if !ok || len(rest) < 2 {
+		return "", "", ErrorInvalidText
+	}
+
+	compressed, method := rest[0], rest[1]
+
+	// the language tag and translated keyword aren't part of the pair
+	_, rest, ok = cutNull(rest[2:])
+	if !ok {
+		return "", "", ErrorInvalidText
+	}
+	_, text, ok := cutNull(rest)
+	if !ok {
+		return "", "", ErrorInvalidText
+	}
+
+	if compressed == 1 {
+		var err error
+		if text, err = inflateText(method, text, limit); err != nil {
+			return "", "", err
+		}
+	}
+	return latin1(keyword), string(text), nil
+}
+
+// inflateText decompresses text stored with the given compression method, only zlib (0) is defined,
+// failing once it inflates past limit bytes
+func inflateText(method byte, data []byte, limit int64) ([]byte, error) {
+	if method != 0 {
+		return nil, fmt.Errorf("%w: unknown compression method %d", ErrorInvalidText, method)
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	text, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(text)) > limit {
+		return nil, fmt.Errorf("%w: inflates to more than %d bytes", ErrorTextTooLarge, limit)
+	}
+	return text, nil
+}
+
+// cutNull splits data around the first null byte
+func cutNull(data []byte) ([]byte, []byte, bool) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return nil, nil, false
+	}
+	return data[:i], data[i+1:], true
+}
+
+// toLatin1 converts a UTF-8 string to ISO 8859-1 bytes, failing on characters it can't hold
+func toLatin1(s string) ([]byte, bool) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return nil, false
+		}
+		b = append(b, byte(r))
+	}
+	return b, true
+}
+
+// latin1 converts ISO 8859-1 bytes to a UTF-8 string
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
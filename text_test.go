@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"testing"
+)
+
+func TestAddTextWithoutIEND(t *testing.T) {
+	chunks := palettePNG(t)
+	png, errs := ReadLenient(bytes.NewReader(encode(t, chunks[:len(chunks)-1]...)), ReadOptions{})
+	if !png.MissingIEND {
+		t.Fatalf("read a PNG missing its IEND without noticing: %v", errs)
+	}
+
+	if err := png.AddText("Software", "png-stripper"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := png.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("tEXtSoftware\x00png-stripper")) {
+		t.Errorf("the tEXt chunk wasn't written: %v", chunkTypes(png))
+	}
+}
+
+func TestTextMetadataMaxTextLength(t *testing.T) {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(make([]byte, 4<<20))
+	w.Close()
+
+	// a few kilobytes of zTXt and iTXt inflating to megabytes of text
+	ztxt := newChunk("zTXt", append([]byte("Comment\x00\x00"), compressed.Bytes()...))
+	itxt := newChunk("iTXt", append([]byte("Comment\x00\x01\x00\x00\x00"), compressed.Bytes()...))
+
+	for _, chunk := range []*Chunk{ztxt, itxt} {
+		chunks := palettePNG(t)
+		chunks = append(chunks[:len(chunks)-1], chunk, chunks[len(chunks)-1])
+		png := mustRead(t, encode(t, chunks...))
+
+		if _, err := png.TextMetadata(); !errors.Is(err, ErrorTextTooLarge) {
+			t.Errorf("%s with the default limit: got %v, want %v", chunk.Type, err, ErrorTextTooLarge)
+		}
+
+		metadata, err := png.TextMetadataWithOptions(TextOptions{MaxTextLength: 4 << 20})
+		if err != nil || len(metadata["Comment"]) != 4<<20 {
+			t.Errorf("%s with a 4MB limit: %d bytes of text, %v", chunk.Type, len(metadata["Comment"]), err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrorChunkOrder     = errors.New("invalid chunk order")
+	ErrorDuplicateChunk = errors.New("duplicate chunk")
+	ErrorMissingChunk   = errors.New("missing chunk")
+	ErrorReservedBit    = errors.New("reserved bit set in chunk type")
+)
+
+// placement holds where the spec allows an ancillary chunk relative to PLTE and IDAT
+type placement struct {
+	beforePLTE bool
+	afterPLTE  bool
+	beforeIDAT bool
+	unique     bool
+}
+
+// placements lists the ordering rules from the PNG spec, chunks not listed may go
+// anywhere between IHDR and IEND
+var placements = map[string]placement{
+	"PLTE": {beforeIDAT: true, unique: true},
+	"cHRM": {beforePLTE: true, beforeIDAT: true, unique: true},
+	"gAMA": {beforePLTE: true, beforeIDAT: true, unique: true},
+	"iCCP": {beforePLTE: true, beforeIDAT: true, unique: true},
+	"sBIT": {beforePLTE: true, beforeIDAT: true, unique: true},
+	"sRGB": {beforePLTE: true, beforeIDAT: true, unique: true},
+	"bKGD": {afterPLTE: true, beforeIDAT: true, unique: true},
+	"hIST": {afterPLTE: true, beforeIDAT: true, unique: true},
+	"tRNS": {afterPLTE: true, beforeIDAT: true, unique: true},
+	"pHYs": {beforeIDAT: true, unique: true},
+	"sPLT": {beforeIDAT: true},
+	"tIME": {unique: true},
+}
+
+// placementOrder keeps the errors Validate reports in a stable order
+var placementOrder = []string{"PLTE", "cHRM", "gAMA", "iCCP", "sBIT", "sRGB", "bKGD", "hIST", "tRNS", "pHYs", "sPLT", "tIME"}
+
+//Validate checks the chunk layout against the PNG spec, returning every violation found
+func (p *PNG) Validate() []error {
+	var errs []error
+	order := p.chunks()
+
+	if len(order) == 0 {
+		return []error{ErrorMissingIHDR}
+	}
+
+	if first := order[0]; first.Type != "IHDR" {
+		errs = append(errs, fmt.Errorf("%w: IHDR must be the first chunk, found %s", ErrorChunkOrder, first.Type))
+	}
+	// the last chunk of a file cut short isn't out of place, the rest of the file is missing
+	if p.MissingIEND || len(p.Chunks["IEND"]) == 0 {
+		errs = append(errs, ErrorMissingIEND)
+	} else if last := order[len(order)-1]; last.Type != "IEND" {
+		errs = append(errs, fmt.Errorf("%w: IEND must be the last chunk, found %s", ErrorChunkOrder, last.Type))
+	}
+
+	// anything repeated here usually means two files were glued together
+	for _, chunkType := range []string{"IHDR", "IEND"} {
+		if n := len(p.Chunks[chunkType]); n > 1 {
+			errs = append(errs, fmt.Errorf("%w: %d %s chunks, expected one", ErrorDuplicateChunk, n, chunkType))
+		}
+	}
+
+	for _, chunkType := range placementOrder {
+		if n := len(p.Chunks[chunkType]); placements[chunkType].unique && n > 1 {
+			errs = append(errs, fmt.Errorf("%w: %d %s chunks, expected at most one", ErrorDuplicateChunk, n, chunkType))
+		}
+	}
+
+	if len(p.Chunks["IDAT"]) == 0 {
+		errs = append(errs, fmt.Errorf("%w: no IDAT chunks", ErrorMissingChunk))
+	}
+	if len(p.Chunks["iCCP"]) > 0 && len(p.Chunks["sRGB"]) > 0 {
+		errs = append(errs, fmt.Errorf("%w: iCCP and sRGB must not both be present", ErrorChunkOrder))
+	}
+
+	for i, chunk := range order {
+		if chunk.reservedBitSet() {
+			errs = append(errs, fmt.Errorf("%w: %s at chunk %d", ErrorReservedBit, chunk.Type, i))
+		}
+	}
+
+	if _, _, _, colorType, _, _, _, err := p.IHDR(); err == nil {
+		hasPLTE := len(p.Chunks["PLTE"]) > 0
+		if colorType == 3 && !hasPLTE {
+			errs = append(errs, fmt.Errorf("%w: indexed colour needs a PLTE chunk", ErrorMissingChunk))
+		}
+		if (colorType == 0 || colorType == 4) && hasPLTE {
+			errs = append(errs, fmt.Errorf("%w: grayscale images must not have a PLTE chunk", ErrorChunkOrder))
+		}
+	}
+
+	return append(errs, p.validateOrder()...)
+}
+
+//VerifyError holds every problem PNG.Verify found. errors.Is and errors.As match any of them.
+type VerifyError struct {
+	Errs []error
+}
+
+func (e *VerifyError) Error() string {
+	if len(e.Errs) == 1 {
+		return e.Errs[0].Error()
+	}
+
+	messages := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d problems: %s", len(e.Errs), strings.Join(messages, "; "))
+}
+
+func (e *VerifyError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *VerifyError) As(target interface{}) bool {
+	for _, err := range e.Errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+//Verify checks the whole PNG in one go: the signature, the length and CRC of every chunk and the
+//layout rules of Validate. It returns nil or a *VerifyError holding everything wrong with it.
+func (p *PNG) Verify() error {
+	var errs []error
+	if p.FileHeader != nil {
+		if err := p.FileHeader.Verify(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	order := p.chunks()
+	offsets := chunkOffsets(order)
+	for i, chunk := range order {
+		if _, err := chunk.Verify(); err != nil {
+			errs = append(errs, &ChunkError{Type: chunk.Type, Index: i, Offset: offsets[i], Err: err})
+		}
+	}
+
+	if errs = append(errs, p.Validate()...); len(errs) > 0 {
+		return &VerifyError{Errs: errs}
+	}
+	return nil
+}
+
+// validateOrder walks the chunks in file order checking each against its placement
+// and that the IDAT chunks form one unbroken run
+func (p *PNG) validateOrder() []error {
+	var errs []error
+	seenPLTE, seenIDAT, idatEnded, splitReported := false, false, false, false
+
+	for i, chunk := range p.chunks() {
+		if chunk.Type == "IDAT" {
+			// only report the first break in the run
+			if idatEnded && !splitReported {
+				errs = append(errs, fmt.Errorf("%w: IDAT at chunk %d doesn't follow the previous IDAT", ErrorChunkOrder, i))
+				splitReported = true
+			}
+			seenIDAT = true
+			continue
+		}
+
+		if seenIDAT && chunk.Type != "IEND" {
+			idatEnded = true
+		}
+
+		rule, ok := placements[chunk.Type]
+		if !ok {
+			continue
+		}
+
+		if rule.beforeIDAT && seenIDAT {
+			errs = append(errs, fmt.Errorf("%w: %s at chunk %d must come before IDAT", ErrorChunkOrder, chunk.Type, i))
+		}
+		if rule.beforePLTE && seenPLTE {
+			errs = append(errs, fmt.Errorf("%w: %s at chunk %d must come before PLTE", ErrorChunkOrder, chunk.Type, i))
+		}
+		if rule.afterPLTE && !seenPLTE && len(p.Chunks["PLTE"]) > 0 {
+			errs = append(errs, fmt.Errorf("%w: %s at chunk %d must come after PLTE", ErrorChunkOrder, chunk.Type, i))
+		}
+
+		if chunk.Type == "PLTE" {
+			seenPLTE = true
+		}
+	}
+	return errs
+}
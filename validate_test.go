@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// validate parses the chunks and returns what Validate finds wrong with them
+func validate(t *testing.T, chunks ...*Chunk) []error {
+	t.Helper()
+
+	png, errs := ReadLenient(bytes.NewReader(encode(t, chunks...)), ReadOptions{})
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	return png.Validate()
+}
+
+func TestValidate(t *testing.T) {
+	chunks := palettePNG(t)
+	header, plte, trns, data, tail := chunks[0], chunks[1], chunks[2], chunks[3:6], chunks[6:]
+	text := newChunk("tEXt", []byte("Comment\x00between"))
+
+	join := func(parts ...interface{}) []*Chunk {
+		var joined []*Chunk
+		for _, part := range parts {
+			switch part := part.(type) {
+			case *Chunk:
+				joined = append(joined, part)
+			case []*Chunk:
+				joined = append(joined, part...)
+			}
+		}
+		return joined
+	}
+
+	tests := []struct {
+		name   string
+		chunks []*Chunk
+		// want holds part of the message of each error expected, in order
+		want []string
+	}{
+		{"valid", chunks, nil},
+		{"PLTE after IDAT", join(header, trns, data, plte, tail), []string{
+			"tRNS at chunk 1 must come after PLTE",
+			"PLTE at chunk 5 must come before IDAT",
+		}},
+		{"PLTE between IDATs", join(header, data[0], plte, trns, data[1:], tail), []string{
+			"PLTE at chunk 2 must come before IDAT",
+			"tRNS at chunk 3 must come before IDAT",
+			"IDAT at chunk 4 doesn't follow the previous IDAT",
+		}},
+		{"split IDAT run", join(header, plte, trns, data[0], text, data[1:], tail), []string{
+			"IDAT at chunk 5 doesn't follow the previous IDAT",
+		}},
+		// only the first break is reported
+		{"split twice", join(header, plte, trns, data[0], text, data[1], text, data[2], tail), []string{
+			"IDAT at chunk 5 doesn't follow the previous IDAT",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := validate(t, test.chunks...)
+			if len(errs) != len(test.want) {
+				t.Fatalf("got %d errors %v, want %d", len(errs), errs, len(test.want))
+			}
+
+			for i, err := range errs {
+				if !errors.Is(err, ErrorChunkOrder) {
+					t.Errorf("error %d: %v isn't an ErrorChunkOrder", i, err)
+				}
+				if !strings.Contains(err.Error(), test.want[i]) {
+					t.Errorf("error %d: %q doesn't mention %q", i, err, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyMissingIEND(t *testing.T) {
+	chunks := palettePNG(t)
+	text := newChunk("tEXt", []byte("Comment\x00last"))
+	chunks = append(chunks[:len(chunks)-1], text)
+
+	png, _ := ReadLenient(bytes.NewReader(encode(t, chunks...)), ReadOptions{})
+	err := png.Verify()
+	if !errors.Is(err, ErrorMissingIEND) {
+		t.Fatalf("got %v, want %v", err, ErrorMissingIEND)
+	}
+	if strings.Contains(err.Error(), "must be the last chunk") {
+		t.Errorf("%q blames the chunk order", err)
+	}
+}